@@ -0,0 +1,269 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultGroupSize is the number of buckets per GROUP BY level when the
+// statement has no LIMIT.
+const DefaultGroupSize = 100
+
+// Rows represents an aggregation result flattened into a table. There is
+// one column for the BUCKET BY interval, one per GROUP BY field and one per
+// metric.
+type Rows struct {
+	Columns []string
+	Values  [][]interface{}
+}
+
+// bucketLevel describes one level of nested bucket aggregations.
+type bucketLevel struct {
+	name   string // aggregation name
+	column string // result column
+	agg    map[string]interface{}
+}
+
+// isAggregate returns true if stmt is compiled into aggregations rather
+// than a hit list.
+func isAggregate(stmt *SelectStatement) bool {
+	return stmt.Interval != "" || len(stmt.GroupBy) > 0 || len(stmt.Metrics) > 0
+}
+
+// bucketLevels returns the bucket aggregations of stmt, outermost first.
+func (c *Compiler) bucketLevels(stmt *SelectStatement) []*bucketLevel {
+	size := DefaultGroupSize
+	if stmt.Limit > 0 {
+		size = stmt.Limit
+	}
+
+	var levels []*bucketLevel
+	if stmt.Interval != "" {
+		levels = append(levels, &bucketLevel{
+			name:   "time",
+			column: c.TimeField,
+			agg:    map[string]interface{}{"date_histogram": c.dateHistogram(stmt)},
+		})
+	}
+	for i, ref := range stmt.GroupBy {
+		levels = append(levels, &bucketLevel{
+			name:   "group_" + strconv.Itoa(i),
+			column: ref.Field,
+			agg: map[string]interface{}{
+				"terms": map[string]interface{}{"field": ref.Field, "size": size},
+			},
+		})
+	}
+	return levels
+}
+
+// dateHistogram returns the `date_histogram` for the statement's BUCKET BY
+// interval. The AT window sets `extended_bounds` so empty buckets at either
+// end are returned too.
+func (c *Compiler) dateHistogram(stmt *SelectStatement) map[string]interface{} {
+	key, interval := histogramInterval(stmt.Interval)
+	h := map[string]interface{}{
+		"field":         c.TimeField,
+		key:             interval,
+		"format":        timeFormat,
+		"min_doc_count": c.MinDocCount,
+	}
+	if c.TimeZone != "" {
+		h["time_zone"] = c.TimeZone
+	}
+	if tr := stmt.Time; tr != nil {
+		bounds := make(map[string]interface{})
+		if tr.Begin != nil {
+			bounds["min"] = timeBoundValue(tr.Begin)
+		}
+		if tr.End != nil {
+			bounds["max"] = timeBoundValue(tr.End)
+		}
+		h["extended_bounds"] = bounds
+	}
+	return h
+}
+
+// histogramInterval returns the `date_histogram` parameter and value for
+// an interval. A single minute, hour, day, week, month, quarter or year is
+// a `calendar_interval`, so `1d` follows daylight saving changes. Other
+// intervals are a `fixed_interval`, which has no week unit.
+func histogramInterval(interval string) (string, string) {
+	i := strings.IndexFunc(interval, func(r rune) bool { return !isDigit(r) })
+	if i < 0 {
+		return "fixed_interval", interval
+	}
+	n, unit := interval[:i], interval[i:]
+	switch {
+	case n == "1" && unit != "ms" && unit != "s":
+		return "calendar_interval", interval
+	case unit == "w":
+		v, _ := strconv.Atoi(n)
+		return "fixed_interval", strconv.Itoa(v*7) + "d"
+	case unit == "M", unit == "q", unit == "y":
+		return "calendar_interval", interval // rejected by the parser
+	}
+	return "fixed_interval", interval
+}
+
+// metricsOf returns the metrics of stmt. Buckets without metrics report
+// their document count.
+func metricsOf(stmt *SelectStatement) []*Metric {
+	if len(stmt.Metrics) == 0 {
+		return []*Metric{{Func: "COUNT", Field: "*"}}
+	}
+	return stmt.Metrics
+}
+
+// metricName returns the aggregation name of the i-th metric.
+func metricName(i int) string { return "metric_" + strconv.Itoa(i) }
+
+// metricColumn returns the result column of a metric, such as `SUM(bytes)`.
+func metricColumn(m *Metric) string { return m.Func + "(" + m.Field + ")" }
+
+// compileAggs sets the `aggs` of req to nested bucket aggregations, a
+// date histogram outside the GROUP BY terms, with the metrics at the
+// innermost level. No hits are returned.
+func (c *Compiler) compileAggs(req *Request, stmt *SelectStatement) error {
+	metrics := make(map[string]interface{})
+	for i, m := range stmt.Metrics {
+		var agg map[string]interface{}
+		switch m.Func {
+		case "COUNT":
+			if m.Field == "*" {
+				continue // read from doc_count
+			}
+			agg = map[string]interface{}{"value_count": map[string]interface{}{"field": m.Field}}
+		case "SUM", "AVG", "MIN", "MAX", "CARDINALITY":
+			agg = map[string]interface{}{strings.ToLower(m.Func): map[string]interface{}{"field": m.Field}}
+		default:
+			return fmt.Errorf("unknown metric function %s", m.Func)
+		}
+		metrics[metricName(i)] = agg
+	}
+
+	// Build the levels from the inside out.
+	aggs := metrics
+	levels := c.bucketLevels(stmt)
+	for i := len(levels) - 1; i >= 0; i-- {
+		agg := make(map[string]interface{}, len(levels[i].agg)+1)
+		for k, v := range levels[i].agg {
+			agg[k] = v
+		}
+		if len(aggs) > 0 {
+			agg["aggs"] = aggs
+		}
+		aggs = map[string]interface{}{levels[i].name: agg}
+	}
+
+	req.Body["size"] = 0
+	if len(aggs) > 0 {
+		req.Body["aggs"] = aggs
+	}
+	// Without buckets COUNT(*) is the hit total, which Elasticsearch 7
+	// stops counting at 10000 unless asked to track it.
+	if len(levels) == 0 {
+		for _, m := range stmt.Metrics {
+			if m.Func == "COUNT" && m.Field == "*" {
+				req.Body["track_total_hits"] = true
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// DecodeRows flattens the aggregations of a `_search` response to stmt
+// into rows, one per innermost bucket.
+func (c *Compiler) DecodeRows(stmt *SelectStatement, resp []byte) (*Rows, error) {
+	var body struct {
+		Hits struct {
+			Total interface{} `json:"total"`
+		} `json:"hits"`
+		Aggregations map[string]interface{} `json:"aggregations"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(resp))
+	dec.UseNumber()
+	if err := dec.Decode(&body); err != nil {
+		return nil, err
+	}
+
+	levels := c.bucketLevels(stmt)
+	rows := &Rows{}
+	for _, l := range levels {
+		rows.Columns = append(rows.Columns, l.column)
+	}
+	metrics := metricsOf(stmt)
+	for _, m := range metrics {
+		rows.Columns = append(rows.Columns, metricColumn(m))
+	}
+
+	// Hits report the total as a number before Elasticsearch 7 and as
+	// {"value": n} since.
+	total := body.Hits.Total
+	if m, ok := total.(map[string]interface{}); ok {
+		total = m["value"]
+	}
+
+	var walk func(aggs map[string]interface{}, depth int, docCount interface{}, key []interface{}) error
+	walk = func(aggs map[string]interface{}, depth int, docCount interface{}, key []interface{}) error {
+		if depth == len(levels) {
+			row := append([]interface{}{}, key...)
+			for i, m := range metrics {
+				if m.Func == "COUNT" && m.Field == "*" {
+					row = append(row, jsonValue(docCount))
+					continue
+				}
+				agg, _ := aggs[metricName(i)].(map[string]interface{})
+				if agg == nil {
+					return fmt.Errorf("aggregation %s missing from response", metricName(i))
+				}
+				row = append(row, jsonValue(agg["value"]))
+			}
+			rows.Values = append(rows.Values, row)
+			return nil
+		}
+
+		agg, _ := aggs[levels[depth].name].(map[string]interface{})
+		if agg == nil {
+			return fmt.Errorf("aggregation %s missing from response", levels[depth].name)
+		}
+		buckets, _ := agg["buckets"].([]interface{})
+		for _, b := range buckets {
+			bucket, ok := b.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("aggregation %s has a malformed bucket", levels[depth].name)
+			}
+			k := bucket["key"]
+			if s, ok := bucket["key_as_string"]; ok {
+				k = s
+			}
+			if err := walk(bucket, depth+1, bucket["doc_count"], append(key, jsonValue(k))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(body.Aggregations, 0, total, nil); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// jsonValue converts a json.Number to an int64 or float64.
+func jsonValue(v interface{}) interface{} {
+	n, ok := v.(json.Number)
+	if !ok {
+		return v
+	}
+	if i, err := n.Int64(); err == nil {
+		return i
+	}
+	if f, err := n.Float64(); err == nil {
+		return f
+	}
+	return n.String()
+}
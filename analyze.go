@@ -0,0 +1,160 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Analyze resolves every index qualifier in stmt against the statement's
+// index list and rewrites it to the declared name. This covers conditions
+// as well as GROUP BY fields, ORDER keys and metric fields. A qualifier may
+// name its index exactly, in a different case, or by its 1-based position
+// in the list as in `1.field`. References to undeclared indices and
+// references that could mean two different indices are errors.
+func Analyze(stmt Statement) error {
+	var refs []*IndexRef
+	var where Expr
+	switch stmt := stmt.(type) {
+	case *SelectStatement:
+		refs, where = stmt.Indices, stmt.Where
+		for _, ref := range stmt.GroupBy {
+			if err := resolveRef(refs, &ref.Index, ref.Field, ref.Pos); err != nil {
+				return err
+			}
+		}
+		for _, f := range stmt.SortFields {
+			if err := resolveRef(refs, &f.Index, f.Field, f.Pos); err != nil {
+				return err
+			}
+		}
+		for _, m := range stmt.Metrics {
+			if err := resolveRef(refs, &m.Index, m.Field, m.Pos); err != nil {
+				return err
+			}
+		}
+	case *CountStatement:
+		refs, where = stmt.Indices, stmt.Where
+	default:
+		return nil
+	}
+
+	for _, cond := range Conditions(where) {
+		if err := resolveRef(refs, &cond.Index, cond.Field, cond.Pos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveRef resolves an optional index qualifier in place.
+func resolveRef(refs []*IndexRef, index *string, field string, pos Pos) error {
+	if *index == "" {
+		return nil
+	}
+	name, err := resolveIndex(refs, *index, field, pos)
+	if err != nil {
+		return err
+	}
+	*index = name
+	return nil
+}
+
+// resolveIndex returns the declared index that ref, qualifying field,
+// refers to.
+func resolveIndex(refs []*IndexRef, ref, field string, pos Pos) (string, error) {
+	found := ref + "." + field
+
+	// Match by name, preferring the exact spelling over a case-insensitive
+	// match.
+	var byName string
+	var folded []string
+	for _, r := range refs {
+		if r.Name == ref {
+			byName = r.Name
+		} else if strings.EqualFold(r.Name, ref) && !containsString(folded, r.Name) {
+			folded = append(folded, r.Name)
+		}
+	}
+	if byName == "" {
+		switch len(folded) {
+		case 0:
+		case 1:
+			byName = folded[0]
+		default:
+			return "", &ParseError{
+				Message: fmt.Sprintf("index %s in %s is ambiguous: it matches %s", ref, found, strings.Join(folded, " and ")),
+				Found:   found,
+				Pos:     pos,
+			}
+		}
+	}
+
+	// Match by position.
+	byPos := indexAt(refs, ref)
+
+	switch {
+	case byName != "" && byPos != "" && byName != byPos:
+		return "", &ParseError{
+			Message: fmt.Sprintf("index %s in %s is ambiguous: it names index %s and is the position of index %s", ref, found, byName, byPos),
+			Found:   found,
+			Pos:     pos,
+		}
+	case byName != "":
+		return byName, nil
+	case byPos != "":
+		return byPos, nil
+	}
+
+	names := make([]string, len(refs))
+	for i, r := range refs {
+		names[i] = r.Name
+	}
+	return "", &ParseError{
+		Message:  fmt.Sprintf("unknown index %s in %s, the statement declares %s", ref, found, strings.Join(names, ", ")),
+		Found:    found,
+		Expected: names,
+		Pos:      pos,
+	}
+}
+
+// refersToIndex returns true if ref names one of refs, in any case, or is
+// the 1-based position of one.
+func refersToIndex(refs []*IndexRef, ref string) bool {
+	for _, r := range refs {
+		if strings.EqualFold(r.Name, ref) {
+			return true
+		}
+	}
+	return indexAt(refs, ref) != ""
+}
+
+// indexAt returns the name of the index at the 1-based position ref, or ""
+// if ref is not a position in refs.
+func indexAt(refs []*IndexRef, ref string) string {
+	n, err := strconv.Atoi(ref)
+	if err != nil || !isDigits(ref) || n < 1 || n > len(refs) {
+		return ""
+	}
+	return refs[n-1].Name
+}
+
+// isDigits returns true if s is made only of ASCII digits.
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isDigit(rune(s[i])) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// containsString returns true if a contains s.
+func containsString(a []string, s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package parser
+
+// Statement represents a single parsed statement.
+type Statement interface {
+	stmt()
+}
+
+// SelectStatement represents a LOOK statement.
+type SelectStatement struct {
+	Indices    []*IndexRef
+	Fields     []*Field
+	Metrics    []*Metric
+	Where      Expr
+	Time       *TimeRange
+	Interval   string // BUCKET BY interval such as "5m"
+	GroupBy    []*FieldRef
+	SortFields []*SortField
+	Limit      int // 0 when there is no LIMIT
+	Offset     int
+}
+
+// CountStatement represents a TOTAL statement.
+type CountStatement struct {
+	Indices []*IndexRef
+	Where   Expr
+	Time    *TimeRange
+}
+
+// RecentStatement represents a RECENT statement.
+type RecentStatement struct {
+	Indices []*IndexRef
+	Size    int
+	Time    *TimeRange
+}
+
+func (*SelectStatement) stmt() {}
+func (*CountStatement) stmt()  {}
+func (*RecentStatement) stmt() {}
+
+// IndexRef represents an `index'type` pair in the index list.
+type IndexRef struct {
+	Name string
+	Type string // empty if the index is given without a type
+}
+
+// Field represents an item of the LOOK projection list.
+type Field struct {
+	Pattern  string // field name, may contain "*" wildcards
+	Exclude  bool   // `-pattern` removes matching fields from _source
+	DocValue bool   // `DOCVALUE(field)` also fetches the field's doc values
+}
+
+// Metric represents a metric function call in the projection list, such
+// as `SUM(web.bytes)` or `COUNT(*)`.
+type Metric struct {
+	Func  string // COUNT, SUM, AVG, MIN, MAX or CARDINALITY
+	Index string // optional index qualifier
+	Field string // "*" for COUNT(*)
+	Pos   Pos    // position of the field, zero if not parsed
+}
+
+// FieldRef represents an optionally index-qualified field.
+type FieldRef struct {
+	Index string
+	Field string
+	Pos   Pos // position of the field, zero if not parsed
+}
+
+// SortField represents a key of the ORDER clause.
+type SortField struct {
+	Index string // optional index qualifier
+	Field string // field name or "_score"
+	Desc  bool
+	Nulls string // "", "FIRST" or "LAST"
+	Pos   Pos    // position of the field, zero if not parsed
+}
+
+// Expr represents a node in a CONDITION expression.
+type Expr interface {
+	expr()
+}
+
+// BinaryExpr represents an AND or OR of two expressions.
+type BinaryExpr struct {
+	Op  Token // AND or OR
+	LHS Expr
+	RHS Expr
+}
+
+// NotExpr represents a negated expression.
+type NotExpr struct {
+	Expr Expr
+}
+
+// ParenExpr represents a parenthesized expression.
+type ParenExpr struct {
+	Expr Expr
+}
+
+func (*BinaryExpr) expr() {}
+func (*NotExpr) expr()    {}
+func (*ParenExpr) expr()  {}
+func (*Condition) expr()  {}
+
+// Conditions returns the conditions of expr in source order.
+func Conditions(expr Expr) []*Condition {
+	var a []*Condition
+	var walk func(Expr)
+	walk = func(expr Expr) {
+		switch expr := expr.(type) {
+		case *BinaryExpr:
+			walk(expr.LHS)
+			walk(expr.RHS)
+		case *NotExpr:
+			walk(expr.Expr)
+		case *ParenExpr:
+			walk(expr.Expr)
+		case *Condition:
+			a = append(a, expr)
+		}
+	}
+	walk(expr)
+	return a
+}
+
+// Condition represents a single `index.field OP value` condition. An
+// empty Index, written `*.field`, applies the condition to every index.
+type Condition struct {
+	Index string
+	Field string
+	Op    Token // GT, GTE, LT, LTE, EQ, NEQ, PF or SF
+	Value Literal
+	Pos   Pos // position of the index name, zero if not parsed
+}
+
+// TimeRange represents the AT window. A nil bound leaves that side open.
+type TimeRange struct {
+	Begin *TimeBound
+	End   *TimeBound
+}
@@ -0,0 +1,324 @@
+// Package client runs parsed statements against an Elasticsearch cluster.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	parser "github.com/Maary/elastic_search_parser"
+)
+
+// DefaultURL is the cluster address used by NewClient.
+const DefaultURL = "http://localhost:9200"
+
+// Client sends compiled statements to an Elasticsearch cluster.
+type Client struct {
+	// URL is the base address of the cluster, such as
+	// "http://localhost:9200". An `httptest.Server` URL works as well.
+	URL string
+
+	// Transport performs the HTTP requests. If nil, http.DefaultTransport
+	// is used.
+	Transport http.RoundTripper
+
+	// Header is added to every request, for example for authorization.
+	Header http.Header
+
+	// Compiler translates statements into requests. If nil, a compiler
+	// with default settings is used.
+	Compiler *parser.Compiler
+}
+
+// NewClient returns a new instance of Client for the cluster at url.
+func NewClient(url string) *Client {
+	if url == "" {
+		url = DefaultURL
+	}
+	return &Client{URL: url, Compiler: parser.NewCompiler()}
+}
+
+// Result represents the decoded response to a statement.
+type Result struct {
+	// Total is the number of matching documents. It is a lower bound when
+	// Relation is "gte".
+	Total    int64
+	Relation string
+
+	// Hits holds the documents of a LOOK or RECENT statement.
+	Hits []*Hit
+
+	// Rows holds the aggregations of a LOOK statement with GROUP BY,
+	// BUCKET BY or metrics.
+	Rows *parser.Rows
+}
+
+// Hit represents a document in a `_search` response.
+type Hit struct {
+	Index  string                 `json:"_index"`
+	Type   string                 `json:"_type"`
+	ID     string                 `json:"_id"`
+	Score  *float64               `json:"_score"`
+	Source json.RawMessage        `json:"_source"`
+	Fields map[string]interface{} `json:"fields"` // docvalue fields
+	Sort   []interface{}          `json:"sort"`
+}
+
+// Decode unmarshals the `_source` of the hit into v.
+func (h *Hit) Decode(v interface{}) error {
+	if len(h.Source) == 0 {
+		return fmt.Errorf("hit %s has no _source", h.ID)
+	}
+	return json.Unmarshal(h.Source, v)
+}
+
+// Error represents an error response from Elasticsearch.
+type Error struct {
+	StatusCode int
+	Type       string
+	Reason     string
+}
+
+// Error returns the string representation of the error.
+func (e *Error) Error() string {
+	if e.Type == "" {
+		return fmt.Sprintf("elasticsearch: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("elasticsearch: %d %s: %s", e.StatusCode, e.Type, e.Reason)
+}
+
+// Exec compiles stmt and runs it.
+func (c *Client) Exec(ctx context.Context, stmt parser.Statement) (*Result, error) {
+	req, err := c.compiler().Compile(stmt)
+	if err != nil {
+		return nil, err
+	}
+	return c.Run(ctx, stmt, req)
+}
+
+// Run sends req, compiled from stmt, and decodes the response. Cursor
+// requests are paged with search_after.
+func (c *Client) Run(ctx context.Context, stmt parser.Statement, req *parser.Request) (*Result, error) {
+	if req.Endpoint == "_count" {
+		return c.count(ctx, req)
+	} else if req.Cursor {
+		return c.cursor(ctx, req)
+	}
+
+	body, err := c.Do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	result, err := decodeSearch(body)
+	if err != nil {
+		return nil, err
+	}
+	if req.Aggregate {
+		sel, ok := stmt.(*parser.SelectStatement)
+		if !ok {
+			return nil, fmt.Errorf("aggregate request for %T", stmt)
+		}
+		if result.Rows, err = c.compiler().DecodeRows(sel, body); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Do sends req and returns the body of a successful response. Responses
+// with an error status are returned as *Error.
+func (c *Client) Do(ctx context.Context, req *parser.Request) ([]byte, error) {
+	data, err := req.JSON()
+	if err != nil {
+		return nil, err
+	}
+	return c.send(ctx, "POST", req.Path(), bytes.NewReader(data))
+}
+
+// Get returns the body of a GET request for path, such as
+// "/web/_mapping".
+func (c *Client) Get(ctx context.Context, path string) ([]byte, error) {
+	return c.send(ctx, "GET", path, nil)
+}
+
+// send performs a request against the cluster.
+func (c *Client) send(ctx context.Context, method, path string, body io.Reader) ([]byte, error) {
+	hreq, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(c.URL, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.Header {
+		hreq.Header[k] = v
+	}
+	if body != nil {
+		hreq.Header.Set("Content-Type", "application/json")
+	}
+
+	transport := c.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	resp, err := transport.RoundTrip(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, decodeError(resp.StatusCode, data)
+	}
+	return data, nil
+}
+
+// cursor pages past the first req.Skip hits without fetching their
+// sources and then collects the next req.Limit hits, a result window at
+// a time.
+func (c *Client) cursor(ctx context.Context, req *parser.Request) (*Result, error) {
+	window := c.compiler().MaxResultWindow
+	if window <= 0 {
+		window = parser.DefaultMaxResultWindow
+	}
+
+	result := &Result{Relation: "eq"}
+	var after []interface{}
+	for skipped, collected := 0, 0; collected < req.Limit; {
+		page := req.SearchAfter(after)
+		if after == nil {
+			delete(page.Body, "search_after")
+		}
+		skipping := skipped < req.Skip
+		size := req.Limit - collected
+		if skipping {
+			size = req.Skip - skipped
+			page.Body["_source"] = false
+			delete(page.Body, "docvalue_fields")
+		}
+		if size > window {
+			size = window
+		}
+		page.Body["size"] = size
+
+		body, err := c.Do(ctx, page)
+		if err != nil {
+			return nil, err
+		}
+		r, err := decodeSearch(body)
+		if err != nil {
+			return nil, err
+		}
+		if after == nil {
+			result.Total, result.Relation = r.Total, r.Relation
+		}
+		if skipping {
+			skipped += len(r.Hits)
+		} else {
+			collected += len(r.Hits)
+			result.Hits = append(result.Hits, r.Hits...)
+		}
+		if len(r.Hits) < size {
+			break
+		}
+		after = r.Hits[len(r.Hits)-1].Sort
+		if len(after) == 0 {
+			return nil, fmt.Errorf("cursor request returned hits without sort values")
+		}
+	}
+	return result, nil
+}
+
+// count sends a `_count` request.
+func (c *Client) count(ctx context.Context, req *parser.Request) (*Result, error) {
+	body, err := c.Do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Count int64 `json:"count"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	return &Result{Total: resp.Count, Relation: "eq"}, nil
+}
+
+// compiler returns the compiler of the client or a default one. The
+// client is not modified so it can be shared between goroutines.
+func (c *Client) compiler() *parser.Compiler {
+	if c.Compiler == nil {
+		return parser.NewCompiler()
+	}
+	return c.Compiler
+}
+
+// decodeSearch decodes the hits and total of a `_search` response.
+func decodeSearch(body []byte) (*Result, error) {
+	var resp struct {
+		Hits struct {
+			Total json.RawMessage `json:"total"`
+			Hits  []*Hit          `json:"hits"`
+		} `json:"hits"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber() // keep sort values exact for search_after
+	if err := dec.Decode(&resp); err != nil {
+		return nil, err
+	}
+
+	result := &Result{Hits: resp.Hits.Hits, Relation: "eq"}
+
+	// Hits report the total as a number before Elasticsearch 7 and as
+	// {"value": n, "relation": "eq"} since.
+	if total := bytes.TrimSpace(resp.Hits.Total); len(total) > 0 && total[0] == '{' {
+		var t struct {
+			Value    int64  `json:"value"`
+			Relation string `json:"relation"`
+		}
+		if err := json.Unmarshal(total, &t); err != nil {
+			return nil, err
+		}
+		result.Total = t.Value
+		if t.Relation != "" {
+			result.Relation = t.Relation
+		}
+	} else if len(total) > 0 && string(total) != "null" {
+		if err := json.Unmarshal(total, &result.Total); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// decodeError returns the *Error for a failed response.
+func decodeError(status int, body []byte) error {
+	var resp struct {
+		Error json.RawMessage `json:"error"`
+	}
+	e := &Error{StatusCode: status}
+	if json.Unmarshal(body, &resp) != nil || len(resp.Error) == 0 {
+		return e
+	}
+
+	// The error is an object, or a plain string in old versions.
+	var cause struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	}
+	if json.Unmarshal(resp.Error, &cause) == nil {
+		e.Type, e.Reason = cause.Type, cause.Reason
+	} else {
+		var s string
+		if json.Unmarshal(resp.Error, &s) == nil {
+			e.Type = "error"
+			e.Reason = s
+		}
+	}
+	return e
+}
@@ -0,0 +1,285 @@
+package client_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	parser "github.com/Maary/elastic_search_parser"
+	"github.com/Maary/elastic_search_parser/client"
+)
+
+// Ensure the client decodes the hits of a `_search` response, with the
+// total as a number or as an object.
+func TestClient_Exec_Search(t *testing.T) {
+	var tests = []struct {
+		total    string
+		n        int64
+		relation string
+	}{
+		{total: `2`, n: 2, relation: "eq"},
+		{total: `{"value": 10000, "relation": "gte"}`, n: 10000, relation: "gte"},
+	}
+
+	for i, tt := range tests {
+		c, requests := newClient(t, func(w http.ResponseWriter, r *http.Request, body map[string]interface{}) {
+			io.WriteString(w, `{"hits": {"total": `+tt.total+`, "hits": [
+				{"_index": "web", "_type": "doc", "_id": "1", "_score": 1.5, "_source": {"status": 500}},
+				{"_index": "web", "_type": "doc", "_id": "2", "_score": null, "_source": {"status": 503}}
+			]}}`)
+		})
+
+		result, err := c.Exec(context.Background(), mustParse(t, `LOOK (web'doc): CONDITION [web.status GTE 500] AT [now-1d - now]`))
+		if err != nil {
+			t.Fatalf("%d. unexpected error: %s", i, err)
+		}
+		if result.Total != tt.n || result.Relation != tt.relation {
+			t.Errorf("%d. total mismatch: exp=%d %s got=%d %s", i, tt.n, tt.relation, result.Total, result.Relation)
+		}
+		if len(result.Hits) != 2 || result.Hits[0].ID != "1" || result.Hits[1].Score != nil {
+			t.Fatalf("%d. unexpected hits: %+v", i, result.Hits)
+		}
+		var doc struct{ Status int }
+		if err := result.Hits[1].Decode(&doc); err != nil {
+			t.Fatalf("%d. decode error: %s", i, err)
+		} else if doc.Status != 503 {
+			t.Errorf("%d. unexpected document: %+v", i, doc)
+		}
+
+		if r := *requests; len(r) != 1 {
+			t.Fatalf("%d. unexpected request count: %d", i, len(r))
+		} else if r[0].method != "POST" || r[0].path != "/web/_search" {
+			t.Errorf("%d. unexpected request: %s %s", i, r[0].method, r[0].path)
+		}
+	}
+}
+
+// Ensure the client sends TOTAL statements to `_count`.
+func TestClient_Exec_Count(t *testing.T) {
+	c, requests := newClient(t, func(w http.ResponseWriter, r *http.Request, body map[string]interface{}) {
+		io.WriteString(w, `{"count": 42, "_shards": {"total": 1}}`)
+	})
+
+	result, err := c.Exec(context.Background(), mustParse(t, `TOTAL (web'doc): CONDITION [web.status EQ 500] AT [now-1d - now]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Total != 42 || result.Relation != "eq" || result.Hits != nil {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	if r := *requests; len(r) != 1 || r[0].path != "/web/_count" {
+		t.Errorf("unexpected requests: %+v", r)
+	}
+}
+
+// Ensure the client decodes the aggregations of a GROUP BY statement into
+// rows.
+func TestClient_Exec_Rows(t *testing.T) {
+	c, _ := newClient(t, func(w http.ResponseWriter, r *http.Request, body map[string]interface{}) {
+		io.WriteString(w, `{"hits": {"total": {"value": 5, "relation": "eq"}, "hits": []}, "aggregations": {
+			"group_0": {"buckets": [
+				{"key": "a", "doc_count": 3, "metric_1": {"value": 1.5}},
+				{"key": "b", "doc_count": 2, "metric_1": {"value": 4}}
+			]}
+		}}`)
+	})
+
+	result, err := c.Exec(context.Background(), mustParse(t, `LOOK (web'doc): [COUNT(*), AVG(web.ms)] CONDITION [] AT [now-1d - now] GROUP BY [web.host]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := &parser.Rows{
+		Columns: []string{"host", "COUNT(*)", "AVG(ms)"},
+		Values: [][]interface{}{
+			{"a", int64(3), float64(1.5)},
+			{"b", int64(2), int64(4)},
+		},
+	}
+	if !reflect.DeepEqual(result.Rows, exp) {
+		t.Errorf("rows mismatch:\n\nexp=%#v\n\ngot=%#v\n\n", exp, result.Rows)
+	}
+	if result.Total != 5 || len(result.Hits) != 0 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+}
+
+// Ensure error responses are returned as *client.Error.
+func TestClient_Exec_Error(t *testing.T) {
+	var tests = []struct {
+		status int
+		body   string
+		err    *client.Error
+		s      string
+	}{
+		{
+			status: http.StatusBadRequest,
+			body:   `{"error": {"root_cause": [], "type": "parsing_exception", "reason": "unknown query [foo]"}, "status": 400}`,
+			err:    &client.Error{StatusCode: 400, Type: "parsing_exception", Reason: "unknown query [foo]"},
+			s:      "elasticsearch: 400 parsing_exception: unknown query [foo]",
+		},
+		{
+			status: http.StatusNotFound,
+			body:   `{"error": "IndexMissingException[[web] missing]", "status": 404}`,
+			err:    &client.Error{StatusCode: 404, Type: "error", Reason: "IndexMissingException[[web] missing]"},
+			s:      "elasticsearch: 404 error: IndexMissingException[[web] missing]",
+		},
+		{
+			status: http.StatusBadGateway,
+			body:   `<html>bad gateway</html>`,
+			err:    &client.Error{StatusCode: 502},
+			s:      "elasticsearch: 502 Bad Gateway",
+		},
+	}
+
+	for i, tt := range tests {
+		c, _ := newClient(t, func(w http.ResponseWriter, r *http.Request, body map[string]interface{}) {
+			w.WriteHeader(tt.status)
+			io.WriteString(w, tt.body)
+		})
+
+		_, err := c.Exec(context.Background(), mustParse(t, `LOOK (web'doc): CONDITION [] AT [now-1d - now]`))
+		if !reflect.DeepEqual(err, tt.err) {
+			t.Errorf("%d. error mismatch: exp=%#v got=%#v", i, tt.err, err)
+		} else if err.Error() != tt.s {
+			t.Errorf("%d. error string mismatch: exp=%q got=%q", i, tt.s, err.Error())
+		}
+	}
+}
+
+// Ensure cursor requests page past the offset with search_after before
+// returning the requested hits.
+func TestClient_Exec_Cursor(t *testing.T) {
+	// Serve ten documents sorted by their sort value.
+	c, requests := newClient(t, func(w http.ResponseWriter, r *http.Request, body map[string]interface{}) {
+		start := 0
+		if after, ok := body["search_after"].([]interface{}); ok {
+			n, _ := after[0].(float64)
+			start = int(n)
+		}
+		size := int(body["size"].(float64))
+
+		var hits []string
+		for i := start + 1; i <= start+size && i <= 10; i++ {
+			hits = append(hits, `{"_id": "`+strconv.Itoa(i)+`", "sort": [`+strconv.Itoa(i)+`, "`+strconv.Itoa(i)+`"]}`)
+		}
+		io.WriteString(w, `{"hits": {"total": 10, "hits": [`+strings.Join(hits, ",")+`]}}`)
+	})
+	c.Compiler.MaxResultWindow = 4
+	c.Compiler.TieBreaker = "id"
+
+	result, err := c.Exec(context.Background(), mustParse(t, `LOOK (web'doc): CONDITION [] AT [now-1d - now] ORDER [web.n] LIMIT 2 OFFSET 5`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, h := range result.Hits {
+		ids = append(ids, h.ID)
+	}
+	if !reflect.DeepEqual(ids, []string{"6", "7"}) {
+		t.Errorf("unexpected hits: %v", ids)
+	}
+
+	// The offset is skipped in pages no larger than the window without
+	// fetching sources.
+	r := *requests
+	if len(r) != 3 {
+		t.Fatalf("unexpected request count: %d", len(r))
+	}
+	for i, exp := range []struct {
+		size  float64
+		after interface{}
+	}{
+		{size: 4, after: nil},
+		{size: 1, after: []interface{}{float64(4), "4"}},
+		{size: 2, after: []interface{}{float64(5), "5"}},
+	} {
+		if size := r[i].body["size"]; size != exp.size {
+			t.Errorf("%d. size mismatch: exp=%v got=%v", i, exp.size, size)
+		}
+		if after := r[i].body["search_after"]; !reflect.DeepEqual(after, exp.after) {
+			t.Errorf("%d. search_after mismatch: exp=%v got=%v", i, exp.after, after)
+		}
+		if _, ok := r[i].body["from"]; ok {
+			t.Errorf("%d. unexpected from", i)
+		}
+	}
+	if r[0].body["_source"] != false || r[1].body["_source"] != false {
+		t.Errorf("skip pages fetch _source")
+	}
+	if _, ok := r[2].body["_source"]; ok {
+		t.Errorf("result page disables _source")
+	}
+
+	// An offset past the last hit returns no hits.
+	result, err = c.Exec(context.Background(), mustParse(t, `LOOK (web'doc): CONDITION [] AT [now-1d - now] ORDER [web.n] LIMIT 2 OFFSET 20`))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(result.Hits) != 0 || result.Total != 10 {
+		t.Errorf("unexpected result: %d hits of %d", len(result.Hits), result.Total)
+	}
+
+	// A limit larger than the window is collected a window at a time.
+	*requests = nil
+	result, err = c.Exec(context.Background(), mustParse(t, `LOOK (web'doc): CONDITION [] AT [now-1d - now] ORDER [web.n] LIMIT 6`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids = nil
+	for _, h := range result.Hits {
+		ids = append(ids, h.ID)
+	}
+	if !reflect.DeepEqual(ids, []string{"1", "2", "3", "4", "5", "6"}) {
+		t.Errorf("unexpected hits: %v", ids)
+	}
+	if r := *requests; len(r) != 2 || r[0].body["size"] != float64(4) || r[1].body["size"] != float64(2) {
+		t.Errorf("unexpected requests: %+v", r)
+	}
+
+	// Pages beyond the window need a tie breaker.
+	c.Compiler.TieBreaker = ""
+	if _, err := c.Exec(context.Background(), mustParse(t, `LOOK (web'doc): CONDITION [] AT [now-1d - now] LIMIT 2 OFFSET 5`)); err == nil {
+		t.Errorf("expected error without a tie breaker")
+	}
+}
+
+// request records a request received by the test server.
+type request struct {
+	method string
+	path   string
+	body   map[string]interface{}
+}
+
+// newClient returns a client of a test server that serves requests with fn
+// and the list the requests are recorded in.
+func newClient(t *testing.T, fn func(w http.ResponseWriter, r *http.Request, body map[string]interface{})) (*client.Client, *[]request) {
+	t.Helper()
+	var requests []request
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if r.Body != nil {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+				t.Errorf("invalid request body: %s", err)
+			}
+		}
+		requests = append(requests, request{method: r.Method, path: r.URL.Path, body: body})
+		fn(w, r, body)
+	}))
+	t.Cleanup(s.Close)
+	return client.NewClient(s.URL), &requests
+}
+
+// mustParse parses s or fails the test.
+func mustParse(t *testing.T, s string) parser.Statement {
+	t.Helper()
+	stmt, err := parser.NewParser(strings.NewReader(s)).Parse()
+	if err != nil {
+		t.Fatalf("%q: %s", s, err)
+	}
+	return stmt
+}
@@ -0,0 +1,463 @@
+// Command esql is an interactive shell for LOOK, TOTAL, RECENT and SQL
+// SELECT statements.
+//
+// Statements may span several lines and end with a `;` or a blank line.
+// Without -url the shell prints the Elasticsearch request of each
+// statement. With -url it runs the statement and prints the results as a
+// table.
+//
+// `esql translate [file ...]` compiles files of statements into NDJSON
+// records instead, and exits with status 1 if any statement failed.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	parser "github.com/Maary/elastic_search_parser"
+	"github.com/Maary/elastic_search_parser/client"
+)
+
+const usage = `Meta commands:
+  \explain [stmt]   print the request of stmt or the last statement
+  \format [stmt]    print stmt or the last statement in canonical form
+  \schema index     print the mapped fields of an index
+  \history [n]      list the history or run its n-th entry
+  \help             print this message
+  \q                quit
+`
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "translate" {
+		err := NewTranslateCommand().Run(os.Args[2:])
+		switch {
+		case err == flag.ErrHelp:
+			os.Exit(0)
+		case err == ErrFailed:
+			os.Exit(1)
+		case err != nil:
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		return
+	}
+
+	m := NewMain()
+	if err := m.ParseFlags(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := m.Run(os.Stdin); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Main represents the shell.
+type Main struct {
+	Client      *client.Client // nil if no endpoint is configured
+	Compiler    *parser.Compiler
+	Schema      *parser.Schema
+	HistoryPath string
+
+	Stdout io.Writer
+	Stderr io.Writer
+
+	history []string
+	last    string // last statement entered
+}
+
+// NewMain returns a new instance of Main.
+func NewMain() *Main {
+	return &Main{
+		Compiler: parser.NewCompiler(),
+		Schema:   parser.NewSchema(),
+		Stdout:   os.Stdout,
+		Stderr:   os.Stderr,
+	}
+}
+
+// ParseFlags parses the command line arguments.
+func (m *Main) ParseFlags(args []string) error {
+	fs := flag.NewFlagSet("esql", flag.ContinueOnError)
+	url := fs.String("url", "", "Elasticsearch endpoint, such as http://localhost:9200")
+	timeField := fs.String("time-field", parser.DefaultTimeField, "field the AT window applies to")
+	tieBreaker := fs.String("tie-breaker", "", "unique field to page with search_after beyond the result window")
+	mappingTypes := fs.Bool("mapping-types", false, "put mapping types in request paths, for Elasticsearch before 7")
+	history := fs.String("history", defaultHistoryPath(), "history file, empty to disable")
+	var mappings []string
+	fs.Func("mapping", "`file` with a _mapping response to validate against (repeatable)", func(s string) error {
+		mappings = append(mappings, s)
+		return nil
+	})
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	m.Compiler.TimeField = *timeField
+	m.Compiler.TieBreaker = *tieBreaker
+	m.Compiler.MappingTypes = *mappingTypes
+	m.HistoryPath = *history
+	for _, path := range mappings {
+		if err := m.Schema.LoadFile(path); err != nil {
+			return err
+		}
+	}
+	if *url != "" {
+		m.Client = client.NewClient(*url)
+		m.Client.Compiler = m.Compiler
+	}
+	return nil
+}
+
+// defaultHistoryPath returns ~/.esql_history, or "" without a home
+// directory.
+func defaultHistoryPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".esql_history")
+}
+
+// Run reads statements and meta commands from r until EOF or `\q`.
+func (m *Main) Run(r io.Reader) error {
+	m.loadHistory()
+
+	scanner := bufio.NewScanner(r)
+	var buf []string
+	for {
+		if len(buf) == 0 {
+			fmt.Fprint(m.Stdout, "esql> ")
+		} else {
+			fmt.Fprint(m.Stdout, "   -> ")
+		}
+		if !scanner.Scan() {
+			break
+		}
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+
+		// Meta commands are only recognized at the start of a statement.
+		if len(buf) == 0 && strings.HasPrefix(trimmed, `\`) {
+			if quit := m.meta(trimmed); quit {
+				return nil
+			}
+			continue
+		}
+
+		switch {
+		case trimmed == "" && len(buf) == 0:
+			continue
+		case trimmed == "":
+		case strings.HasSuffix(trimmed, ";"):
+			buf = append(buf, strings.TrimSuffix(strings.TrimRight(line, " \t"), ";"))
+		default:
+			buf = append(buf, line)
+			continue
+		}
+
+		m.exec(strings.Join(buf, "\n"))
+		buf = nil
+	}
+	if len(buf) > 0 {
+		m.exec(strings.Join(buf, "\n"))
+	}
+	fmt.Fprintln(m.Stdout)
+	return scanner.Err()
+}
+
+// meta runs a meta command and returns true if the shell should quit.
+func (m *Main) meta(line string) bool {
+	name, arg := line, ""
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		name, arg = line[:i], strings.TrimSpace(line[i+1:])
+	}
+	arg = strings.TrimSuffix(arg, ";")
+
+	switch name {
+	case `\q`, `\quit`:
+		return true
+	case `\help`, `\?`:
+		fmt.Fprint(m.Stdout, usage)
+	case `\explain`:
+		if stmt, ok := m.statement(arg); ok {
+			m.explain(stmt)
+		}
+	case `\format`:
+		if stmt, ok := m.statement(arg); ok {
+			fmt.Fprintln(m.Stdout, parser.Format(stmt))
+		}
+	case `\schema`:
+		m.schema(arg)
+	case `\history`:
+		if arg == "" {
+			for i, s := range m.history {
+				fmt.Fprintf(m.Stdout, "%4d  %s\n", i+1, strings.Replace(s, "\n", "\n      ", -1))
+			}
+			break
+		}
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 || n > len(m.history) {
+			fmt.Fprintf(m.Stderr, "no history entry %s\n", arg)
+			break
+		}
+		fmt.Fprintln(m.Stdout, m.history[n-1])
+		m.exec(m.history[n-1])
+	default:
+		fmt.Fprintf(m.Stderr, "unknown command %s, try \\help\n", name)
+	}
+	return false
+}
+
+// statement parses src, or the last statement if src is empty.
+func (m *Main) statement(src string) (parser.Statement, bool) {
+	if src == "" {
+		src = m.last
+	}
+	if src == "" {
+		fmt.Fprintln(m.Stderr, "no statement")
+		return nil, false
+	}
+	stmt, err := m.parse(src)
+	if err != nil {
+		fmt.Fprintf(m.Stderr, "error: %s\n", err)
+		return nil, false
+	}
+	return stmt, true
+}
+
+// parse parses a single statement, validating it against the loaded
+// mappings.
+func (m *Main) parse(src string) (parser.Statement, error) {
+	p := m.Compiler.NewParser(strings.NewReader(src))
+	p.Schema = m.Schema
+	return p.Parse()
+}
+
+// exec parses and runs the statements of src, or explains them without
+// an endpoint.
+func (m *Main) exec(src string) {
+	src = strings.TrimSpace(src)
+	if src == "" {
+		return
+	}
+	m.addHistory(src)
+
+	p := m.Compiler.NewParser(strings.NewReader(src))
+	p.Schema = m.Schema
+	for {
+		stmt, span, err := p.Next()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			fmt.Fprintf(m.Stderr, "error: %s\n", err)
+			continue
+		}
+		m.last = span.Source(src)
+
+		if m.Client == nil {
+			m.explain(stmt)
+			continue
+		}
+		result, err := m.Client.Exec(context.Background(), stmt)
+		if err != nil {
+			fmt.Fprintf(m.Stderr, "error: %s\n", err)
+			continue
+		}
+		m.printResult(result)
+	}
+}
+
+// explain prints the request of stmt.
+func (m *Main) explain(stmt parser.Statement) {
+	req, err := m.Compiler.Compile(stmt)
+	if err != nil {
+		fmt.Fprintf(m.Stderr, "error: %s\n", err)
+		return
+	}
+	body, err := json.MarshalIndent(req.Body, "", "  ")
+	if err != nil {
+		fmt.Fprintf(m.Stderr, "error: %s\n", err)
+		return
+	}
+	fmt.Fprintf(m.Stdout, "POST %s\n%s\n", req.Path(), body)
+	if req.Cursor {
+		fmt.Fprintf(m.Stdout, "(paged with search_after: %d hits after the first %d)\n", req.Limit, req.Skip)
+	}
+}
+
+// schema prints the fields of index, fetching its mapping from the
+// endpoint if it was not loaded.
+func (m *Main) schema(index string) {
+	if index == "" {
+		fmt.Fprintln(m.Stderr, `usage: \schema index`)
+		return
+	}
+	if !m.Schema.HasIndex(index) {
+		if m.Client == nil {
+			fmt.Fprintf(m.Stderr, "no mapping loaded for %s\n", index)
+			return
+		}
+		body, err := m.Client.Get(context.Background(), "/"+index+"/_mapping")
+		if err != nil {
+			fmt.Fprintf(m.Stderr, "error: %s\n", err)
+			return
+		}
+		if err := m.Schema.Load(bytes.NewReader(body)); err != nil {
+			fmt.Fprintf(m.Stderr, "error: %s\n", err)
+			return
+		}
+	}
+
+	w := tabwriter.NewWriter(m.Stdout, 0, 8, 2, ' ', 0)
+	for _, typ := range m.Schema.Types(index) {
+		name := index
+		if typ != "" {
+			name += "'" + typ
+		}
+		fmt.Fprintf(w, "%s\n", name)
+		fields := m.Schema.Fields(index, typ)
+		names := make([]string, 0, len(fields))
+		for f := range fields {
+			names = append(names, f)
+		}
+		sort.Strings(names)
+		for _, f := range names {
+			fmt.Fprintf(w, "  %s\t%s\n", f, fields[f])
+		}
+	}
+	w.Flush()
+}
+
+// printResult prints the rows, hits or total of a result as a table.
+func (m *Main) printResult(result *client.Result) {
+	w := tabwriter.NewWriter(m.Stdout, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+
+	switch {
+	case result.Rows != nil:
+		fmt.Fprintln(w, strings.Join(result.Rows.Columns, "\t"))
+		for _, row := range result.Rows.Values {
+			cells := make([]string, len(row))
+			for i, v := range row {
+				cells[i] = cell(v)
+			}
+			fmt.Fprintln(w, strings.Join(cells, "\t"))
+		}
+		fmt.Fprintf(w, "(%d rows)\n", len(result.Rows.Values))
+	case result.Hits != nil:
+		// Columns are the union of the top-level source fields.
+		var docs []map[string]interface{}
+		seen := make(map[string]bool)
+		var columns []string
+		for _, h := range result.Hits {
+			doc := make(map[string]interface{})
+			if len(h.Source) > 0 {
+				if err := h.Decode(&doc); err != nil {
+					fmt.Fprintf(m.Stderr, "error: %s\n", err)
+					return
+				}
+			}
+			for k, v := range h.Fields {
+				doc[k] = v
+			}
+			for k := range doc {
+				if !seen[k] {
+					seen[k] = true
+					columns = append(columns, k)
+				}
+			}
+			docs = append(docs, doc)
+		}
+		sort.Strings(columns)
+
+		fmt.Fprintln(w, strings.Join(append([]string{"_index", "_id"}, columns...), "\t"))
+		for i, h := range result.Hits {
+			cells := []string{h.Index, h.ID}
+			for _, c := range columns {
+				cells = append(cells, cell(docs[i][c]))
+			}
+			fmt.Fprintln(w, strings.Join(cells, "\t"))
+		}
+		fmt.Fprintf(w, "(%d of %s hits)\n", len(result.Hits), total(result))
+	default:
+		fmt.Fprintf(w, "%s\n", total(result))
+	}
+}
+
+// total returns the total of a result, marked when it is a lower bound.
+func total(result *client.Result) string {
+	s := strconv.FormatInt(result.Total, 10)
+	if result.Relation == "gte" {
+		s = ">=" + s
+	}
+	return s
+}
+
+// cell returns the table text of a value.
+func cell(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return v
+	case map[string]interface{}, []interface{}:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+	return fmt.Sprint(v)
+}
+
+// loadHistory reads the history file, if any.
+func (m *Main) loadHistory() {
+	if m.HistoryPath == "" {
+		return
+	}
+	data, err := os.ReadFile(m.HistoryPath)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintf(m.Stderr, "history: %s\n", err)
+		}
+		return
+	}
+	// Entries are stored one per line with newlines escaped.
+	for _, line := range strings.Split(string(data), "\n") {
+		if s, err := strconv.Unquote(line); err == nil {
+			m.history = append(m.history, s)
+		}
+	}
+	if n := len(m.history); n > 0 {
+		m.last = m.history[n-1]
+	}
+}
+
+// addHistory records a statement and appends it to the history file.
+func (m *Main) addHistory(src string) {
+	if n := len(m.history); n > 0 && m.history[n-1] == src {
+		return
+	}
+	m.history = append(m.history, src)
+	if m.HistoryPath == "" {
+		return
+	}
+	f, err := os.OpenFile(m.HistoryPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		fmt.Fprintf(m.Stderr, "history: %s\n", err)
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, strconv.Quote(src))
+}
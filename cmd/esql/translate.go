@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	parser "github.com/Maary/elastic_search_parser"
+)
+
+// TranslateCommand compiles files of statements into NDJSON records.
+type TranslateCommand struct {
+	Compiler *parser.Compiler
+	Schema   *parser.Schema
+
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// NewTranslateCommand returns a new instance of TranslateCommand.
+func NewTranslateCommand() *TranslateCommand {
+	return &TranslateCommand{
+		Compiler: parser.NewCompiler(),
+		Schema:   parser.NewSchema(),
+		Stdin:    os.Stdin,
+		Stdout:   os.Stdout,
+		Stderr:   os.Stderr,
+	}
+}
+
+// ErrFailed is returned by TranslateCommand.Run when a statement failed.
+var ErrFailed = errors.New("translate: some statements failed")
+
+// Record represents the translation of one statement.
+type Record struct {
+	File    string         `json:"file"`
+	Line    int            `json:"line"`
+	Source  string         `json:"source"`
+	Kind    string         `json:"kind"` // LOOK, TOTAL, RECENT or SELECT
+	Request *RequestRecord `json:"request,omitempty"`
+	Error   *ErrorRecord   `json:"error,omitempty"`
+}
+
+// RequestRecord represents a compiled request.
+type RequestRecord struct {
+	Method string                 `json:"method"`
+	Path   string                 `json:"path"`
+	Body   map[string]interface{} `json:"body"`
+	Cursor bool                   `json:"cursor,omitempty"`
+	Skip   int                    `json:"skip,omitempty"`
+	Limit  int                    `json:"limit,omitempty"`
+}
+
+// ErrorRecord represents a failed statement. Line and Column are file
+// positions, zero if the error has no position.
+type ErrorRecord struct {
+	Message string `json:"message"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+}
+
+// Run translates the files named in args, or stdin for none or "-".
+func (cmd *TranslateCommand) Run(args []string) error {
+	fs := flag.NewFlagSet("esql translate", flag.ContinueOnError)
+	fs.SetOutput(cmd.Stderr)
+	timeField := fs.String("time-field", parser.DefaultTimeField, "field the AT window applies to")
+	tieBreaker := fs.String("tie-breaker", "", "unique field to page with search_after beyond the result window")
+	mappingTypes := fs.Bool("mapping-types", false, "put mapping types in request paths, for Elasticsearch before 7")
+	fs.Func("mapping", "`file` with a _mapping response to validate against (repeatable)", cmd.Schema.LoadFile)
+	fs.Usage = func() {
+		fmt.Fprintln(cmd.Stderr, "usage: esql translate [flags] [file ...]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	cmd.Compiler.TimeField = *timeField
+	cmd.Compiler.TieBreaker = *tieBreaker
+	cmd.Compiler.MappingTypes = *mappingTypes
+
+	files := fs.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	enc := json.NewEncoder(cmd.Stdout)
+	enc.SetEscapeHTML(false)
+	failed := false
+	for _, name := range files {
+		var data []byte
+		var err error
+		if name == "-" {
+			data, err = io.ReadAll(cmd.Stdin)
+		} else {
+			data, err = os.ReadFile(name)
+		}
+		if err != nil {
+			return err
+		}
+
+		records, err := cmd.translate(name, string(data))
+		if err != nil {
+			return err
+		}
+		for _, rec := range records {
+			if rec.Error != nil {
+				failed = true
+			}
+			if err := enc.Encode(rec); err != nil {
+				return err
+			}
+		}
+	}
+	if failed {
+		return ErrFailed
+	}
+	return nil
+}
+
+// translate parses and compiles the statements of src.
+func (cmd *TranslateCommand) translate(name, src string) ([]*Record, error) {
+	p := cmd.Compiler.NewParser(strings.NewReader(src))
+	p.Schema = cmd.Schema
+
+	var records []*Record
+	for {
+		stmt, span, err := p.Next()
+		if err == io.EOF {
+			return records, nil
+		}
+		source := span.Source(src)
+		rec := &Record{File: name, Line: span.Start.Line, Source: source, Kind: statementKind(source)}
+		records = append(records, rec)
+
+		if err != nil {
+			rec.Error = &ErrorRecord{Message: err.Error()}
+			if e, ok := err.(*parser.ParseError); ok {
+				rec.Error.Line, rec.Error.Column = e.Pos.Line, e.Pos.Column
+			}
+			continue
+		}
+
+		req, err := cmd.Compiler.Compile(stmt)
+		if err != nil {
+			rec.Error = &ErrorRecord{Message: err.Error()}
+			continue
+		}
+		rec.Request = &RequestRecord{
+			Method: "POST",
+			Path:   req.Path(),
+			Body:   req.Body,
+			Cursor: req.Cursor,
+			Skip:   req.Skip,
+			Limit:  req.Limit,
+		}
+	}
+}
+
+// statementKind returns the keyword a statement starts with, or "" if it
+// does not start with LOOK, TOTAL, RECENT or SELECT.
+func statementKind(source string) string {
+	tok, _, _ := parser.NewScanner(strings.NewReader(source)).Scan()
+	switch tok {
+	case parser.LOOK, parser.TOTAL, parser.RECENT, parser.SELECT:
+		return tok.String()
+	}
+	return ""
+}
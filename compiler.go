@@ -0,0 +1,560 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// DefaultTimeField is the document field the AT window is applied to.
+const DefaultTimeField = "@timestamp"
+
+// DefaultMaxResultWindow is the default `index.max_result_window` setting.
+const DefaultMaxResultWindow = 10000
+
+// timeFormat is the Elasticsearch date format of the AT bounds in compiled
+// requests, and timeLayout the Go layout they are written with.
+const (
+	timeFormat = "strict_date_optional_time"
+	timeLayout = "2006-01-02T15:04:05.000Z07:00"
+)
+
+// Request represents a compiled Elasticsearch request.
+type Request struct {
+	Indices  []string               // target indices
+	Types    []string               // target mapping types, if any
+	Endpoint string                 // "_search" or "_count"
+	Body     map[string]interface{} // request body
+
+	// Cursor is set when the page ends beyond the result window. The
+	// request then has no `from`; the caller must page past the first
+	// Skip hits with SearchAfter and then collect Limit hits, a window at
+	// a time.
+	Cursor bool
+	Skip   int
+	Limit  int
+
+	// Aggregate is set when the results are in the aggregations of the
+	// response, to be read with DecodeRows, rather than in its hits.
+	Aggregate bool
+}
+
+// Path returns the URL path the request should be sent to, such as
+// `/web/_search`, with the mapping types after the indices if any.
+func (r *Request) Path() string {
+	path := "/" + strings.Join(r.Indices, ",")
+	if len(r.Types) > 0 {
+		path += "/" + strings.Join(r.Types, ",")
+	}
+	return path + "/" + r.Endpoint
+}
+
+// SearchAfter returns a copy of the request that continues after the hit
+// with the given sort values.
+func (r *Request) SearchAfter(values []interface{}) *Request {
+	other := *r
+	other.Body = make(map[string]interface{}, len(r.Body)+1)
+	for k, v := range r.Body {
+		other.Body[k] = v
+	}
+	other.Body["search_after"] = values
+	return &other
+}
+
+// JSON returns the encoded request body.
+func (r *Request) JSON() ([]byte, error) {
+	return json.Marshal(r.Body)
+}
+
+// Compiler translates statements into Elasticsearch query DSL.
+type Compiler struct {
+	// TimeField is the field the AT window is applied to.
+	TimeField string
+
+	// MaxResultWindow is the `index.max_result_window` of the target
+	// indices. Pages ending beyond it are compiled as cursor requests.
+	MaxResultWindow int
+
+	// TieBreaker is a unique field, such as an event id with doc values,
+	// added to the sort of cursor requests so every hit has its own sort
+	// position. Pages beyond MaxResultWindow cannot be compiled without
+	// one: `_id` has no doc values in recent Elasticsearch versions.
+	TieBreaker string
+
+	// TimeZone is the `time_zone` of BUCKET BY histograms, such as
+	// "+08:00" or "Asia/Shanghai". Empty means UTC.
+	TimeZone string
+
+	// MinDocCount is the `min_doc_count` of BUCKET BY histograms.
+	MinDocCount int
+
+	// MappingTypes puts the mapping types of the statement in the request
+	// path, as in `/web/doc/_search`. Only Elasticsearch before 7 filters
+	// by type; later versions deprecate or reject typed paths.
+	MappingTypes bool
+}
+
+// NewCompiler returns a new instance of Compiler with default settings.
+func NewCompiler() *Compiler {
+	return &Compiler{
+		TimeField:       DefaultTimeField,
+		MaxResultWindow: DefaultMaxResultWindow,
+	}
+}
+
+// NewParser returns a new parser for r whose SQL statements take their AT
+// window from a BETWEEN on the compiler's TimeField.
+func (c *Compiler) NewParser(r io.Reader) *Parser {
+	p := NewParser(r)
+	p.timeField = c.TimeField
+	return p
+}
+
+// Compile compiles a statement into a `_search` or `_count` request.
+// RECENT statements are sorted newest first on the time field. LOOK
+// statements with GROUP BY or metric functions return aggregations only,
+// with LIMIT bounding the buckets per group.
+// Field names are used unqualified. When the statement lists several
+// indices, a qualified condition is scoped with an `_index` term so it
+// only filters the documents of its own index; under NOT or OR it only
+// matches them.
+func (c *Compiler) Compile(stmt Statement) (*Request, error) {
+	switch stmt := stmt.(type) {
+	case *SelectStatement:
+		req, err := c.compile("_search", stmt.Indices, stmt.Where, stmt.Time)
+		if err != nil {
+			return nil, err
+		}
+		if isAggregate(stmt) {
+			if err := c.compileAggs(req, stmt); err != nil {
+				return nil, err
+			}
+			req.Aggregate = true
+			return req, nil
+		}
+		c.compileFields(req, stmt.Fields)
+		if len(stmt.SortFields) > 0 {
+			req.Body["sort"] = c.compileSort(stmt.SortFields)
+		}
+		if err := c.compilePage(req, stmt.Limit, stmt.Offset); err != nil {
+			return nil, err
+		}
+		return req, nil
+	case *CountStatement:
+		return c.compile("_count", stmt.Indices, stmt.Where, stmt.Time)
+	case *RecentStatement:
+		req, err := c.compile("_search", stmt.Indices, nil, stmt.Time)
+		if err != nil {
+			return nil, err
+		}
+		req.Body["sort"] = []interface{}{
+			map[string]interface{}{c.TimeField: map[string]interface{}{"order": "desc"}},
+		}
+		if err := c.compilePage(req, stmt.Size, 0); err != nil {
+			return nil, err
+		}
+		return req, nil
+	}
+	return nil, fmt.Errorf("cannot compile %T", stmt)
+}
+
+// compile builds a request for the given statement parts.
+func (c *Compiler) compile(endpoint string, refs []*IndexRef, where Expr, tr *TimeRange) (*Request, error) {
+	req := &Request{Endpoint: endpoint}
+
+	// Collect the indices and types in a stable order.
+	indices := make(map[string]bool)
+	types := make(map[string]bool)
+	for _, ref := range refs {
+		indices[ref.Name] = true
+		if ref.Type != "" && c.MappingTypes {
+			types[ref.Type] = true
+		}
+	}
+	req.Indices = sortedKeys(indices)
+	req.Types = sortedKeys(types)
+	if len(req.Indices) == 0 {
+		return nil, fmt.Errorf("statement has no index")
+	}
+
+	s := scopeNone
+	if len(req.Indices) > 1 {
+		s = scopeItem
+	}
+	query, err := c.compileQuery(where, tr, s)
+	if err != nil {
+		return nil, err
+	}
+	req.Body = map[string]interface{}{"query": query}
+	return req, nil
+}
+
+// compileFields adds `_source` filtering and `docvalue_fields` for the
+// projection list. A list made only of DOCVALUE items disables _source.
+func (c *Compiler) compileFields(req *Request, fields []*Field) {
+	if len(fields) == 0 {
+		return
+	}
+
+	var includes, excludes, docvalues []interface{}
+	for _, f := range fields {
+		switch {
+		case f.DocValue:
+			docvalues = append(docvalues, f.Pattern)
+		case f.Exclude:
+			excludes = append(excludes, f.Pattern)
+		default:
+			includes = append(includes, f.Pattern)
+		}
+	}
+
+	if len(includes) == 0 && len(excludes) == 0 {
+		req.Body["_source"] = false
+	} else {
+		source := make(map[string]interface{})
+		if len(includes) > 0 {
+			source["includes"] = includes
+		}
+		if len(excludes) > 0 {
+			source["excludes"] = excludes
+		}
+		req.Body["_source"] = source
+	}
+	if len(docvalues) > 0 {
+		req.Body["docvalue_fields"] = docvalues
+	}
+}
+
+// compileSort returns the `sort` array for the ORDER clause.
+func (c *Compiler) compileSort(fields []*SortField) []interface{} {
+	a := make([]interface{}, 0, len(fields))
+	for _, f := range fields {
+		opt := map[string]interface{}{"order": "asc"}
+		if f.Desc {
+			opt["order"] = "desc"
+		}
+		switch f.Nulls {
+		case "FIRST":
+			opt["missing"] = "_first"
+		case "LAST":
+			opt["missing"] = "_last"
+		}
+		a = append(a, map[string]interface{}{f.Field: opt})
+	}
+	return a
+}
+
+// compilePage sets `size` and `from` for LIMIT and OFFSET. When the page
+// ends beyond MaxResultWindow the request becomes a cursor request that
+// must be paged with search_after, sorted on the TieBreaker last.
+func (c *Compiler) compilePage(req *Request, limit, offset int) error {
+	size := limit
+	if size == 0 {
+		size = 10 // Elasticsearch default
+	}
+	if c.MaxResultWindow <= 0 || offset+size <= c.MaxResultWindow {
+		if limit > 0 {
+			req.Body["size"] = limit
+		}
+		if offset > 0 {
+			req.Body["from"] = offset
+		}
+		return nil
+	}
+
+	if c.TieBreaker == "" {
+		return fmt.Errorf("page ends at hit %d, beyond the result window of %d: set a tie breaker field to page with search_after", offset+size, c.MaxResultWindow)
+	}
+	req.Cursor, req.Skip, req.Limit = true, offset, size
+	if size > c.MaxResultWindow {
+		size = c.MaxResultWindow
+	}
+	req.Body["size"] = size
+	sort, _ := req.Body["sort"].([]interface{})
+	req.Body["sort"] = append(sort, map[string]interface{}{c.TieBreaker: map[string]interface{}{"order": "asc"}})
+	return nil
+}
+
+// compileQuery builds the `bool` query for the condition and time window.
+// Qualified conditions are restricted to the documents of their index as
+// given by s.
+func (c *Compiler) compileQuery(where Expr, tr *TimeRange, s scope) (map[string]interface{}, error) {
+	b := &boolQuery{}
+	if where != nil {
+		if err := c.addMust(b, where, s); err != nil {
+			return nil, err
+		}
+	}
+	if tr != nil {
+		b.must = append(b.must, c.compileTimeRange(tr))
+	}
+	if b.empty() {
+		return map[string]interface{}{"match_all": map[string]interface{}{}}, nil
+	}
+	return b.query(), nil
+}
+
+// compileExpr returns the query for a condition expression.
+func (c *Compiler) compileExpr(expr Expr, s scope) (map[string]interface{}, error) {
+	switch expr := expr.(type) {
+	case *ParenExpr:
+		return c.compileExpr(expr.Expr, s)
+	case *BinaryExpr:
+		b := &boolQuery{}
+		var err error
+		if expr.Op == OR {
+			err = c.addShould(b, expr, s.nested())
+		} else {
+			err = c.addMust(b, expr, s)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return b.query(), nil
+	case *NotExpr, *Condition:
+		b := &boolQuery{}
+		if err := c.addMust(b, expr, s); err != nil {
+			return nil, err
+		}
+		if len(b.must) == 1 && len(b.mustNot) == 0 {
+			return b.must[0].(map[string]interface{}), nil
+		}
+		return b.query(), nil
+	}
+	return nil, fmt.Errorf("cannot compile expression %T", expr)
+}
+
+// addMust adds expr to the `must` and `must_not` clauses of b, flattening
+// nested ANDs and negations.
+func (c *Compiler) addMust(b *boolQuery, expr Expr, s scope) error {
+	switch expr := expr.(type) {
+	case *ParenExpr:
+		return c.addMust(b, expr.Expr, s)
+	case *BinaryExpr:
+		if expr.Op == AND {
+			if err := c.addMust(b, expr.LHS, s); err != nil {
+				return err
+			}
+			return c.addMust(b, expr.RHS, s)
+		}
+	case *NotExpr:
+		clause, err := c.compileExpr(expr.Expr, s.nested())
+		if err != nil {
+			return err
+		}
+		b.mustNot = append(b.mustNot, clause)
+		return nil
+	case *Condition:
+		clause, err := c.compileCondition(expr)
+		if err != nil {
+			return err
+		}
+		leaf := &boolQuery{}
+		if _, ok := expr.Value.(*NullLiteral); ok && expr.Op == NEQ {
+			leaf.must = append(leaf.must, map[string]interface{}{"exists": map[string]interface{}{"field": expr.Field}})
+		} else if expr.Op == NEQ {
+			leaf.mustNot = append(leaf.mustNot, clause)
+		} else {
+			leaf.must = append(leaf.must, clause)
+		}
+		if expr.Index != "" {
+			switch s {
+			case scopeItem:
+				b.must = append(b.must, scopeQuery(expr.Index, leaf))
+				return nil
+			case scopeLeaf:
+				b.must = append(b.must, indexTerm(expr.Index))
+			}
+		}
+		b.must = append(b.must, leaf.must...)
+		b.mustNot = append(b.mustNot, leaf.mustNot...)
+		return nil
+	}
+
+	clause, err := c.compileExpr(expr, s)
+	if err != nil {
+		return err
+	}
+	b.must = append(b.must, clause)
+	return nil
+}
+
+// addShould adds expr to the `should` clauses of b, flattening nested ORs.
+func (c *Compiler) addShould(b *boolQuery, expr Expr, s scope) error {
+	switch expr := expr.(type) {
+	case *ParenExpr:
+		return c.addShould(b, expr.Expr, s)
+	case *BinaryExpr:
+		if expr.Op == OR {
+			if err := c.addShould(b, expr.LHS, s); err != nil {
+				return err
+			}
+			return c.addShould(b, expr.RHS, s)
+		}
+	}
+
+	clause, err := c.compileExpr(expr, s)
+	if err != nil {
+		return err
+	}
+	b.should = append(b.should, clause)
+	return nil
+}
+
+// boolQuery accumulates the clauses of a `bool` query.
+type boolQuery struct {
+	must    []interface{}
+	should  []interface{}
+	mustNot []interface{}
+}
+
+// empty returns true if b has no clauses.
+func (b *boolQuery) empty() bool {
+	return len(b.must) == 0 && len(b.should) == 0 && len(b.mustNot) == 0
+}
+
+// query returns the `bool` query for b.
+func (b *boolQuery) query() map[string]interface{} {
+	m := make(map[string]interface{})
+	if len(b.must) > 0 {
+		m["must"] = b.must
+	}
+	if len(b.should) > 0 {
+		m["should"] = b.should
+		m["minimum_should_match"] = 1
+	}
+	if len(b.mustNot) > 0 {
+		m["must_not"] = b.mustNot
+	}
+	return map[string]interface{}{"bool": m}
+}
+
+// scope tells how a condition qualified with an index is restricted to the
+// documents of that index when a request spans several indices.
+type scope int
+
+const (
+	// scopeNone leaves conditions unrestricted, for single index requests.
+	scopeNone scope = iota
+
+	// scopeItem is used for the items of the top-level AND chain. The
+	// documents of other indices pass the condition.
+	scopeItem
+
+	// scopeLeaf is used under NOT and OR, where letting other documents
+	// pass would change the meaning of the expression. Only documents of
+	// the index match the condition.
+	scopeLeaf
+)
+
+// nested returns the scope of the operands of a NOT or an OR.
+func (s scope) nested() scope {
+	if s == scopeNone {
+		return scopeNone
+	}
+	return scopeLeaf
+}
+
+// scopeQuery returns a query matching the documents of other indices and
+// the documents of index that match leaf.
+func scopeQuery(index string, leaf *boolQuery) map[string]interface{} {
+	var q interface{}
+	if len(leaf.must) == 1 && len(leaf.mustNot) == 0 {
+		q = leaf.must[0]
+	} else {
+		q = leaf.query()
+	}
+	other := &boolQuery{mustNot: []interface{}{indexTerm(index)}}
+	return (&boolQuery{should: []interface{}{other.query(), q}}).query()
+}
+
+// indexTerm returns a query matching the documents of index.
+func indexTerm(index string) map[string]interface{} {
+	return map[string]interface{}{"term": map[string]interface{}{"_index": index}}
+}
+
+// compileCondition returns the leaf query for a single condition.
+// NEQ returns the positive term query; addMust negates it.
+func (c *Compiler) compileCondition(cond *Condition) (map[string]interface{}, error) {
+	switch cond.Op {
+	case GT, GTE, LT, LTE:
+		return map[string]interface{}{
+			"range": map[string]interface{}{
+				cond.Field: map[string]interface{}{strings.ToLower(cond.Op.String()): cond.Value.Value()},
+			},
+		}, nil
+	case EQ, NEQ:
+		if _, ok := cond.Value.(*NullLiteral); ok {
+			// A field equals NULL when it has no value.
+			return map[string]interface{}{
+				"bool": map[string]interface{}{
+					"must_not": []interface{}{
+						map[string]interface{}{"exists": map[string]interface{}{"field": cond.Field}},
+					},
+				},
+			}, nil
+		}
+		return map[string]interface{}{
+			"term": map[string]interface{}{cond.Field: cond.Value.Value()},
+		}, nil
+	case PF:
+		s, ok := cond.Value.(*StringLiteral)
+		if !ok {
+			return nil, fmt.Errorf("PF on %s expects a string value", cond.Field)
+		}
+		return map[string]interface{}{
+			"prefix": map[string]interface{}{cond.Field: s.Val},
+		}, nil
+	case SF:
+		s, ok := cond.Value.(*StringLiteral)
+		if !ok {
+			return nil, fmt.Errorf("SF on %s expects a string value", cond.Field)
+		}
+		return map[string]interface{}{
+			"wildcard": map[string]interface{}{cond.Field: "*" + escapeWildcard(s.Val)},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown operation %s on %s", cond.Op, cond.Field)
+}
+
+// compileTimeRange returns the range query for the AT window.
+// Date-math bounds are passed through unchanged.
+func (c *Compiler) compileTimeRange(tr *TimeRange) map[string]interface{} {
+	r := make(map[string]interface{})
+	if tr.Begin != nil {
+		r["gte"] = timeBoundValue(tr.Begin)
+	}
+	if tr.End != nil {
+		r["lte"] = timeBoundValue(tr.End)
+	}
+	r["format"] = timeFormat
+	return map[string]interface{}{
+		"range": map[string]interface{}{c.TimeField: r},
+	}
+}
+
+// timeBoundValue returns the JSON value of a time bound.
+func timeBoundValue(b *TimeBound) string {
+	if b.IsMath() {
+		return b.Math
+	}
+	return b.Time.Format(timeLayout)
+}
+
+// escapeWildcard escapes the wildcard metacharacters in s.
+func escapeWildcard(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`)
+	return r.Replace(s)
+}
+
+// sortedKeys returns the keys of m in sorted order.
+func sortedKeys(m map[string]bool) []string {
+	a := make([]string, 0, len(m))
+	for k := range m {
+		a = append(a, k)
+	}
+	sort.Strings(a)
+	return a
+}
@@ -0,0 +1,189 @@
+package parser
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// Ensure conditions compile to the expected query.
+func TestCompiler_Compile_Query(t *testing.T) {
+	var tests = []struct {
+		s     string
+		query string
+	}{
+		// Leaf conditions.
+		{
+			s:     `TOTAL (web'doc): CONDITION [web.a EQ 1] AT [- now]`,
+			query: `{"bool": {"must": [{"term": {"a": 1}}, {"range": {"@timestamp": {"lte": "now", "format": "strict_date_optional_time"}}}]}}`,
+		},
+		{
+			s:     `TOTAL (web'doc): CONDITION [web.a NEQ "x"] AT [- now]`,
+			query: `{"bool": {"must": [{"range": {"@timestamp": {"lte": "now", "format": "strict_date_optional_time"}}}], "must_not": [{"term": {"a": "x"}}]}}`,
+		},
+		{
+			s:     `TOTAL (web'doc): CONDITION [web.a GT 1, web.b GTE 2.5, web.c LT "m", web.d LTE 4] AT [- now]`,
+			query: `{"bool": {"must": [{"range": {"a": {"gt": 1}}}, {"range": {"b": {"gte": 2.5}}}, {"range": {"c": {"lt": "m"}}}, {"range": {"d": {"lte": 4}}}, {"range": {"@timestamp": {"lte": "now", "format": "strict_date_optional_time"}}}]}}`,
+		},
+		{
+			s:     `TOTAL (web'doc): CONDITION [web.path PF "/api", web.file SF "a*b"] AT [- now]`,
+			query: `{"bool": {"must": [{"prefix": {"path": "/api"}}, {"wildcard": {"file": "*a\\*b"}}, {"range": {"@timestamp": {"lte": "now", "format": "strict_date_optional_time"}}}]}}`,
+		},
+		{
+			s:     `TOTAL (web'doc): CONDITION [web.a EQ NULL, web.b NEQ NULL] AT [- now]`,
+			query: `{"bool": {"must": [{"bool": {"must_not": [{"exists": {"field": "a"}}]}}, {"exists": {"field": "b"}}, {"range": {"@timestamp": {"lte": "now", "format": "strict_date_optional_time"}}}]}}`,
+		},
+
+		// Boolean operators.
+		{
+			s:     `TOTAL (web'doc): CONDITION [web.a EQ 1 AND (web.b EQ 2 OR web.c EQ 3)] AT [- now]`,
+			query: `{"bool": {"must": [{"term": {"a": 1}}, {"bool": {"should": [{"term": {"b": 2}}, {"term": {"c": 3}}], "minimum_should_match": 1}}, {"range": {"@timestamp": {"lte": "now", "format": "strict_date_optional_time"}}}]}}`,
+		},
+		{
+			s:     `TOTAL (web'doc): CONDITION [NOT (web.a EQ 1 AND web.b NEQ 2)] AT [- now]`,
+			query: `{"bool": {"must": [{"range": {"@timestamp": {"lte": "now", "format": "strict_date_optional_time"}}}], "must_not": [{"bool": {"must": [{"term": {"a": 1}}], "must_not": [{"term": {"b": 2}}]}}]}}`,
+		},
+		{
+			s:     `TOTAL (web'doc): CONDITION [] AT [now-1d - 2018.11.23:12.23.45]`,
+			query: `{"bool": {"must": [{"range": {"@timestamp": {"gte": "now-1d", "lte": "2018-11-23T12:23:45.000Z", "format": "strict_date_optional_time"}}}]}}`,
+		},
+
+		// Items of the top-level AND only filter their own index.
+		{
+			s:     `TOTAL (a'doc, b'doc): CONDITION [a.x EQ 1, b.y NEQ 2] AT [- now]`,
+			query: `{"bool": {"must": [{"bool": {"should": [{"bool": {"must_not": [{"term": {"_index": "a"}}]}}, {"term": {"x": 1}}], "minimum_should_match": 1}}, {"bool": {"should": [{"bool": {"must_not": [{"term": {"_index": "b"}}]}}, {"bool": {"must_not": [{"term": {"y": 2}}]}}], "minimum_should_match": 1}}, {"range": {"@timestamp": {"lte": "now", "format": "strict_date_optional_time"}}}]}}`,
+		},
+
+		// Under NOT and OR a condition only matches its own index.
+		{
+			s:     `TOTAL (a'doc, b'doc): CONDITION [NOT a.x EQ 1] AT [- now]`,
+			query: `{"bool": {"must": [{"range": {"@timestamp": {"lte": "now", "format": "strict_date_optional_time"}}}], "must_not": [{"bool": {"must": [{"term": {"_index": "a"}}, {"term": {"x": 1}}]}}]}}`,
+		},
+		{
+			s:     `TOTAL (a'doc, b'doc): CONDITION [a.x EQ 1 OR b.y NEQ 2] AT [- now]`,
+			query: `{"bool": {"must": [{"bool": {"should": [{"bool": {"must": [{"term": {"_index": "a"}}, {"term": {"x": 1}}]}}, {"bool": {"must": [{"term": {"_index": "b"}}], "must_not": [{"term": {"y": 2}}]}}], "minimum_should_match": 1}}, {"range": {"@timestamp": {"lte": "now", "format": "strict_date_optional_time"}}}]}}`,
+		},
+
+		// Conditions on every index are not scoped.
+		{
+			s:     `TOTAL (a'doc, b'doc): CONDITION [*.x EQ 1, NOT *.y EQ 2] AT [- now]`,
+			query: `{"bool": {"must": [{"term": {"x": 1}}, {"range": {"@timestamp": {"lte": "now", "format": "strict_date_optional_time"}}}], "must_not": [{"term": {"y": 2}}]}}`,
+		},
+		{
+			s:     `SELECT * FROM a'doc, b'doc WHERE x = 1 AND b.y = 2 AND @timestamp BETWEEN 'now-1h' AND 'now'`,
+			query: `{"bool": {"must": [{"term": {"x": 1}}, {"bool": {"should": [{"bool": {"must_not": [{"term": {"_index": "b"}}]}}, {"term": {"y": 2}}], "minimum_should_match": 1}}, {"range": {"@timestamp": {"gte": "now-1h", "lte": "now", "format": "strict_date_optional_time"}}}]}}`,
+		},
+
+		// The same index with two types is not scoped.
+		{
+			s:     `TOTAL (a'x, a'y): CONDITION [NOT a.x EQ 1] AT [- now]`,
+			query: `{"bool": {"must": [{"range": {"@timestamp": {"lte": "now", "format": "strict_date_optional_time"}}}], "must_not": [{"term": {"x": 1}}]}}`,
+		},
+	}
+
+	for i, tt := range tests {
+		stmt, err := NewParser(strings.NewReader(tt.s)).Parse()
+		if err != nil {
+			t.Errorf("%d. %q: parse error: %s", i, tt.s, err)
+			continue
+		}
+		req, err := NewCompiler().Compile(stmt)
+		if err != nil {
+			t.Errorf("%d. %q: compile error: %s", i, tt.s, err)
+			continue
+		}
+		if exp, got := mustCompactJSON(t, tt.query), mustMarshalJSON(t, req.Body["query"]); exp != got {
+			t.Errorf("%d. %q: query mismatch:\n\nexp=%s\n\ngot=%s\n\n", i, tt.s, exp, got)
+		}
+	}
+}
+
+// Ensure mapping types are only in the request path when enabled.
+func TestRequest_Path(t *testing.T) {
+	for i, tt := range []struct {
+		s     string
+		types bool
+		path  string
+	}{
+		{s: `LOOK (web'doc, app'log): CONDITION [] AT [- now]`, path: "/app,web/_search"},
+		{s: `LOOK (web'doc, app'log): CONDITION [] AT [- now]`, types: true, path: "/app,web/doc,log/_search"},
+		{s: `TOTAL (web'doc): CONDITION [] AT [- now]`, types: true, path: "/web/doc/_count"},
+	} {
+		stmt, err := NewParser(strings.NewReader(tt.s)).Parse()
+		if err != nil {
+			t.Fatalf("%d. %q: parse error: %s", i, tt.s, err)
+		}
+		c := NewCompiler()
+		c.MappingTypes = tt.types
+		req, err := c.Compile(stmt)
+		if err != nil {
+			t.Fatalf("%d. %q: compile error: %s", i, tt.s, err)
+		}
+		if path := req.Path(); path != tt.path {
+			t.Errorf("%d. %q: path mismatch: exp=%s got=%s", i, tt.s, tt.path, path)
+		}
+	}
+}
+
+// Ensure COUNT(*) without buckets tracks the exact hit total.
+func TestCompiler_Compile_TrackTotalHits(t *testing.T) {
+	for i, tt := range []struct {
+		s     string
+		track bool
+	}{
+		{s: `LOOK (web'doc): [COUNT(*), AVG(web.ms)] CONDITION [] AT [- now]`, track: true},
+		{s: `LOOK (web'doc): [AVG(web.ms)] CONDITION [] AT [- now]`, track: false},
+		{s: `LOOK (web'doc): [COUNT(*)] CONDITION [] AT [- now] GROUP BY [web.host]`, track: false},
+	} {
+		stmt, err := NewParser(strings.NewReader(tt.s)).Parse()
+		if err != nil {
+			t.Fatalf("%d. %q: parse error: %s", i, tt.s, err)
+		}
+		req, err := NewCompiler().Compile(stmt)
+		if err != nil {
+			t.Fatalf("%d. %q: compile error: %s", i, tt.s, err)
+		}
+		if _, ok := req.Body["track_total_hits"]; ok != tt.track {
+			t.Errorf("%d. %q: track_total_hits mismatch: exp=%v got=%v", i, tt.s, tt.track, ok)
+		}
+	}
+}
+
+// Ensure SQL statements parsed for a compiler take their window from the
+// compiler's time field.
+func TestCompiler_NewParser(t *testing.T) {
+	c := NewCompiler()
+	c.TimeField = "ts"
+	stmt, err := c.NewParser(strings.NewReader(`SELECT * FROM web WHERE ts BETWEEN 'now-1h' AND 'now'`)).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := c.Compile(stmt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := mustCompactJSON(t, `{"bool": {"must": [{"range": {"ts": {"gte": "now-1h", "lte": "now", "format": "strict_date_optional_time"}}}]}}`)
+	if got := mustMarshalJSON(t, req.Body["query"]); got != exp {
+		t.Errorf("query mismatch:\n\nexp=%s\n\ngot=%s\n\n", exp, got)
+	}
+}
+
+// mustMarshalJSON returns v encoded as JSON or fails the test.
+func mustMarshalJSON(t *testing.T, v interface{}) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// mustCompactJSON returns s reencoded with sorted keys or fails the test.
+func mustCompactJSON(t *testing.T, s string) string {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatalf("invalid JSON %s: %s", s, err)
+	}
+	return mustMarshalJSON(t, v)
+}
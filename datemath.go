@@ -0,0 +1,146 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeBound represents one side of the AT window. It is either an absolute
+// time or an Elasticsearch date-math expression such as `now-15m/d`.
+type TimeBound struct {
+	Time time.Time // absolute time, zero when Math is set
+	Math string    // date-math expression relative to now
+}
+
+// IsMath returns true if the bound is a date-math expression.
+func (b *TimeBound) IsMath() bool { return b.Math != "" }
+
+// Resolve returns the time the bound refers to, evaluating date math
+// against now. When roundUp is set, rounding moves to the last millisecond
+// of the unit, as Elasticsearch does for `lte` bounds.
+func (b *TimeBound) Resolve(now time.Time, roundUp bool) (time.Time, error) {
+	if !b.IsMath() {
+		return b.Time, nil
+	}
+	return EvalDateMath(b.Math, now, roundUp)
+}
+
+// Resolve returns the window's bounds evaluated against the given clock.
+// An open bound is returned as the zero time.
+func (tr *TimeRange) Resolve(clock func() time.Time) (begin, end time.Time, err error) {
+	now := clock()
+	if tr.Begin != nil {
+		if begin, err = tr.Begin.Resolve(now, false); err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+	if tr.End != nil {
+		if end, err = tr.End.Resolve(now, true); err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+	return begin, end, nil
+}
+
+// EvalDateMath evaluates a date-math expression such as `now-1d/d` against
+// now. The expression is `now` followed by any number of `+N<unit>`,
+// `-N<unit>` and `/<unit>` operations where unit is one of y, M, w, d, h,
+// H, m or s.
+func EvalDateMath(expr string, now time.Time, roundUp bool) (time.Time, error) {
+	if !strings.HasPrefix(expr, "now") {
+		return time.Time{}, fmt.Errorf("date math %q must start with now", expr)
+	}
+	t := now
+	s := expr[len("now"):]
+	for s != "" {
+		op := s[0]
+		s = s[1:]
+		switch op {
+		case '+', '-':
+			i := 0
+			for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+				i++
+			}
+			if i == 0 || i == len(s) {
+				return time.Time{}, fmt.Errorf("invalid date math %q", expr)
+			}
+			n, err := strconv.Atoi(s[:i])
+			if err != nil {
+				return time.Time{}, fmt.Errorf("invalid date math %q", expr)
+			}
+			if op == '-' {
+				n = -n
+			}
+			if t, err = addDateUnit(t, n, s[i]); err != nil {
+				return time.Time{}, fmt.Errorf("invalid date math %q: %s", expr, err)
+			}
+			s = s[i+1:]
+		case '/':
+			if s == "" {
+				return time.Time{}, fmt.Errorf("invalid date math %q", expr)
+			}
+			var err error
+			if t, err = roundDateUnit(t, s[0], roundUp); err != nil {
+				return time.Time{}, fmt.Errorf("invalid date math %q: %s", expr, err)
+			}
+			s = s[1:]
+		default:
+			return time.Time{}, fmt.Errorf("invalid date math %q", expr)
+		}
+	}
+	return t, nil
+}
+
+// addDateUnit adds n units to t.
+func addDateUnit(t time.Time, n int, unit byte) (time.Time, error) {
+	switch unit {
+	case 'y':
+		return t.AddDate(n, 0, 0), nil
+	case 'M':
+		return t.AddDate(0, n, 0), nil
+	case 'w':
+		return t.AddDate(0, 0, 7*n), nil
+	case 'd':
+		return t.AddDate(0, 0, n), nil
+	case 'h', 'H':
+		return t.Add(time.Duration(n) * time.Hour), nil
+	case 'm':
+		return t.Add(time.Duration(n) * time.Minute), nil
+	case 's':
+		return t.Add(time.Duration(n) * time.Second), nil
+	}
+	return time.Time{}, fmt.Errorf("unknown unit %q", unit)
+}
+
+// roundDateUnit rounds t down to the start of its unit, or up to the last
+// millisecond of it.
+func roundDateUnit(t time.Time, unit byte, roundUp bool) (time.Time, error) {
+	var start time.Time
+	switch unit {
+	case 'y':
+		start = time.Date(t.Year(), 1, 1, 0, 0, 0, 0, t.Location())
+	case 'M':
+		start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	case 'w':
+		// Weeks start on Monday.
+		d := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+		start = d.AddDate(0, 0, -((int(d.Weekday()) + 6) % 7))
+	case 'd':
+		start = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	case 'h', 'H':
+		start = t.Truncate(time.Hour)
+	case 'm':
+		start = t.Truncate(time.Minute)
+	case 's':
+		start = t.Truncate(time.Second)
+	default:
+		return time.Time{}, fmt.Errorf("unknown unit %q", unit)
+	}
+	if !roundUp {
+		return start, nil
+	}
+	next, _ := addDateUnit(start, 1, unit)
+	return next.Add(-time.Millisecond), nil
+}
@@ -0,0 +1,742 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Unsupported describes a part of an Elasticsearch request body that has
+// no DSL equivalent and was left out of a decompiled statement.
+type Unsupported struct {
+	Path   string // location in the body, such as "query.bool.must[1]"
+	Reason string
+}
+
+// String returns the path and the reason.
+func (u *Unsupported) String() string { return u.Path + ": " + u.Reason }
+
+// Decompiler translates Elasticsearch `_search` bodies back into LOOK
+// statements.
+type Decompiler struct {
+	// TimeField is the field whose range becomes the AT window.
+	TimeField string
+
+	// TimeLayouts are tried, in order, on string bounds of the AT window
+	// that are not date math.
+	TimeLayouts []string
+}
+
+// NewDecompiler returns a new instance of Decompiler with default settings.
+func NewDecompiler() *Decompiler {
+	return &Decompiler{
+		TimeField:   DefaultTimeField,
+		TimeLayouts: DefaultTimeLayouts,
+	}
+}
+
+// Decompile returns the LOOK statement equivalent to a `_search` body sent
+// to the given index. Conditions are qualified with the index name.
+//
+// The `bool`, `range`, `term`, `terms`, `prefix`, `wildcard` (suffix
+// only), `exists` and `match_all` queries are translated, as are
+// `_source`, `docvalue_fields`, `sort`, `size` and `from`. The range on
+// TimeField in the top-level conjunction becomes the AT window; without one
+// the window is left open up to now. Every other part of the body is
+// dropped and reported, so the statement only matches the original when
+// no Unsupported parts are returned.
+func (d *Decompiler) Decompile(ref *IndexRef, body []byte) (*SelectStatement, []*Unsupported, error) {
+	if ref == nil || ref.Name == "" || ref.Type == "" {
+		return nil, nil, fmt.Errorf("decompile requires an index name and type")
+	}
+
+	var m map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&m); err != nil {
+		return nil, nil, err
+	}
+
+	dc := &decompiler{Decompiler: d, index: ref.Name}
+	stmt := &SelectStatement{Indices: []*IndexRef{ref}}
+	dc.stmt = stmt
+	for _, key := range objectKeys(m) {
+		v := m[key]
+		switch key {
+		case "query":
+			stmt.Where = dc.query(key, v, true)
+		case "_source":
+			dc.source(key, v)
+		case "docvalue_fields":
+			dc.docValues(key, v)
+		case "sort":
+			dc.sort(key, v)
+		case "size":
+			if n, ok := jsonInt(v); ok && n > 0 {
+				stmt.Limit = n
+			} else {
+				dc.unsupported(key, "only a positive size can be written as LIMIT")
+			}
+		case "from":
+			if n, ok := jsonInt(v); ok && n >= 0 {
+				stmt.Offset = n
+			} else {
+				dc.unsupported(key, "from must be a non-negative integer")
+			}
+		default:
+			dc.unsupported(key, "no DSL equivalent")
+		}
+	}
+
+	// OFFSET needs a LIMIT; Elasticsearch returns 10 hits by default.
+	if stmt.Offset > 0 && stmt.Limit == 0 {
+		stmt.Limit = 10
+	}
+	if dc.sourceOff {
+		if len(stmt.Fields) == 0 {
+			dc.unsupported("_source", "disabling _source without docvalue_fields has no DSL equivalent")
+		}
+	} else if len(stmt.Fields) > 0 && !hasSourceField(stmt.Fields) {
+		// A list made only of DOCVALUE items disables _source.
+		stmt.Fields = append([]*Field{{Pattern: "*"}}, stmt.Fields...)
+	}
+	if stmt.Time == nil {
+		stmt.Time = &TimeRange{End: &TimeBound{Math: "now"}}
+		dc.unsupported("query", fmt.Sprintf("no range on %s; the AT window is open up to now", d.TimeField))
+	}
+	return stmt, dc.issues, nil
+}
+
+// decompiler holds the state of a single Decompile call.
+type decompiler struct {
+	*Decompiler
+	index     string
+	stmt      *SelectStatement
+	sourceOff bool
+	issues    []*Unsupported
+}
+
+// unsupported records a dropped part of the body.
+func (d *decompiler) unsupported(path, reason string) {
+	d.issues = append(d.issues, &Unsupported{Path: path, Reason: reason})
+}
+
+// query returns the expression for a query clause, or nil if the clause
+// matches everything or was dropped. A time range is only lifted into the
+// AT window when top is set, that is when the clause is ANDed with the
+// whole query.
+func (d *decompiler) query(path string, v interface{}, top bool) Expr {
+	m, ok := v.(map[string]interface{})
+	if !ok || len(m) != 1 {
+		d.unsupported(path, "expected an object with a single query")
+		return nil
+	}
+
+	for kind, body := range m {
+		path := path + "." + kind
+		switch kind {
+		case "match_all":
+			if b, ok := body.(map[string]interface{}); !ok || len(b) > 0 {
+				d.unsupported(path, "match_all options have no DSL equivalent")
+			}
+			return nil
+		case "bool":
+			return d.boolQuery(path, body, top)
+		case "range":
+			return d.rangeQuery(path, body, top)
+		case "term":
+			return d.termQuery(path, body)
+		case "terms":
+			return d.termsQuery(path, body)
+		case "prefix", "wildcard":
+			return d.patternQuery(path, kind, body)
+		case "exists":
+			return d.existsQuery(path, body)
+		}
+		d.unsupported(path, fmt.Sprintf("%s query has no DSL equivalent", kind))
+	}
+	return nil
+}
+
+// boolQuery returns the expression for a `bool` query. Must and filter
+// clauses are ANDed, should clauses are ORed and must_not clauses are
+// negated.
+func (d *decompiler) boolQuery(path string, v interface{}, top bool) Expr {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		d.unsupported(path, "expected an object")
+		return nil
+	}
+
+	var items []Expr
+	for _, key := range []string{"must", "filter"} {
+		for i, c := range jsonArray(m[key]) {
+			if expr := d.query(fmt.Sprintf("%s.%s[%d]", path, key, i), c, top); expr != nil {
+				items = append(items, expr)
+			}
+		}
+	}
+
+	if should := jsonArray(m["should"]); len(should) > 0 {
+		// Should clauses only filter when at least one of them must match.
+		msm, ok := m["minimum_should_match"]
+		required := !ok && m["must"] == nil && m["filter"] == nil
+		if n, ok := jsonInt(msm); ok && n == 1 {
+			required = true
+		} else if s, ok := msm.(string); ok && s == "1" {
+			required = true
+		}
+		if !required {
+			d.unsupported(path+".should", "should clauses that only affect scoring have no DSL equivalent")
+		} else {
+			var ors []Expr
+			for i, c := range should {
+				if expr := d.query(fmt.Sprintf("%s.should[%d]", path, i), c, false); expr != nil {
+					ors = append(ors, expr)
+				}
+			}
+			if expr := orExpr(ors); expr != nil {
+				items = append(items, expr)
+			}
+		}
+	}
+
+	for i, c := range jsonArray(m["must_not"]) {
+		if expr := d.query(fmt.Sprintf("%s.must_not[%d]", path, i), c, false); expr != nil {
+			items = append(items, negate(expr))
+		}
+	}
+
+	for _, key := range objectKeys(m) {
+		switch key {
+		case "must", "filter", "should", "must_not", "minimum_should_match":
+		default:
+			d.unsupported(path+"."+key, "no DSL equivalent")
+		}
+	}
+	return andExpr(items)
+}
+
+// rangeQuery returns the conditions of a `range` query, or sets the AT
+// window for a range on the time field.
+func (d *decompiler) rangeQuery(path string, v interface{}, top bool) Expr {
+	field, opts, ok := d.fieldQuery(path, v)
+	if !ok {
+		return nil
+	}
+	m, ok := opts.(map[string]interface{})
+	if !ok {
+		d.unsupported(path, "expected range options")
+		return nil
+	}
+	if field == d.TimeField && top && d.stmt.Time == nil {
+		d.timeRange(path, m)
+		return nil
+	}
+
+	var items []Expr
+	for _, key := range objectKeys(m) {
+		var op Token
+		switch key {
+		case "gt":
+			op = GT
+		case "gte":
+			op = GTE
+		case "lt":
+			op = LT
+		case "lte":
+			op = LTE
+		default:
+			d.unsupported(path+"."+key, "no DSL equivalent")
+			continue
+		}
+		lit := jsonLiteral(m[key])
+		switch lit.(type) {
+		case *IntegerLiteral, *NumberLiteral, *StringLiteral:
+		default:
+			d.unsupported(path+"."+key, "range bounds must be numbers or strings")
+			continue
+		}
+		if cond := d.condition(path, field, op, lit); cond != nil {
+			items = append(items, cond)
+		}
+	}
+	return andExpr(items)
+}
+
+// timeRange sets the AT window from the options of a range on the time
+// field. Numeric bounds are epoch milliseconds.
+func (d *decompiler) timeRange(path string, m map[string]interface{}) {
+	tr := &TimeRange{}
+	for _, key := range objectKeys(m) {
+		switch key {
+		case "gte", "lte":
+			b := d.timeBound(path+"."+key, m[key])
+			if b == nil {
+				continue
+			}
+			if key == "gte" {
+				tr.Begin = b
+			} else {
+				tr.End = b
+			}
+		case "gt", "lt":
+			d.unsupported(path+"."+key, "the AT window only has inclusive bounds")
+		case "format":
+			// Bounds are parsed with the decompiler's layouts instead.
+		default:
+			d.unsupported(path+"."+key, "no DSL equivalent")
+		}
+	}
+	if tr.Begin == nil && tr.End == nil {
+		d.unsupported(path, "the AT window needs at least one bound")
+		return
+	}
+	if tr.Begin != nil && tr.End != nil && !tr.Begin.IsMath() && !tr.End.IsMath() && tr.Begin.Time.After(tr.End.Time) {
+		d.unsupported(path, "the AT window begins after it ends")
+		return
+	}
+	d.stmt.Time = tr
+}
+
+// timeBound returns the bound of the AT window for a range value.
+func (d *decompiler) timeBound(path string, v interface{}) *TimeBound {
+	switch v := v.(type) {
+	case json.Number:
+		if ms, err := v.Int64(); err == nil {
+			return &TimeBound{Time: time.Unix(ms/1000, ms%1000*int64(time.Millisecond)).UTC()}
+		}
+	case string:
+		if strings.HasPrefix(v, "now") {
+			if _, err := EvalDateMath(v, time.Now(), false); err == nil {
+				return &TimeBound{Math: v}
+			}
+			break
+		}
+		for _, layout := range d.TimeLayouts {
+			if t, err := time.ParseInLocation(layout, v, time.UTC); err == nil {
+				return &TimeBound{Time: t}
+			}
+		}
+	}
+	d.unsupported(path, fmt.Sprintf("cannot read time %v", v))
+	return nil
+}
+
+// termQuery returns the EQ condition of a `term` query.
+func (d *decompiler) termQuery(path string, v interface{}) Expr {
+	field, value, ok := d.fieldQuery(path, v)
+	if !ok {
+		return nil
+	}
+	if value, ok = d.queryValue(path, value); !ok {
+		return nil
+	}
+	lit := jsonLiteral(value)
+	if lit == nil {
+		d.unsupported(path, "term values must be strings, numbers or booleans")
+		return nil
+	}
+	return d.condition(path, field, EQ, lit)
+}
+
+// termsQuery returns the ORed EQ conditions of a `terms` query.
+func (d *decompiler) termsQuery(path string, v interface{}) Expr {
+	field, value, ok := d.fieldQuery(path, v)
+	if !ok {
+		return nil
+	}
+	values, ok := value.([]interface{})
+	if !ok || len(values) == 0 {
+		d.unsupported(path, "only a list of terms can be written as conditions")
+		return nil
+	}
+
+	var ors []Expr
+	for i, value := range values {
+		lit := jsonLiteral(value)
+		if lit == nil {
+			d.unsupported(fmt.Sprintf("%s[%d]", path, i), "term values must be strings, numbers or booleans")
+			continue
+		}
+		if cond := d.condition(path, field, EQ, lit); cond != nil {
+			ors = append(ors, cond)
+		}
+	}
+	return orExpr(ors)
+}
+
+// patternQuery returns the PF condition of a `prefix` query or the SF
+// condition of a `wildcard` query of the form `*suffix`.
+func (d *decompiler) patternQuery(path, kind string, v interface{}) Expr {
+	field, value, ok := d.fieldQuery(path, v)
+	if !ok {
+		return nil
+	}
+	if value, ok = d.queryValue(path, value); !ok {
+		return nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		d.unsupported(path, kind+" values must be strings")
+		return nil
+	}
+	if kind == "prefix" {
+		return d.condition(path, field, PF, &StringLiteral{Val: s})
+	}
+
+	suffix, ok := unescapeWildcard(strings.TrimPrefix(s, "*"))
+	if !ok || !strings.HasPrefix(s, "*") {
+		d.unsupported(path, "only wildcards of the form *suffix can be written as SF")
+		return nil
+	}
+	return d.condition(path, field, SF, &StringLiteral{Val: suffix})
+}
+
+// existsQuery returns the NEQ NULL condition of an `exists` query.
+func (d *decompiler) existsQuery(path string, v interface{}) Expr {
+	m, ok := v.(map[string]interface{})
+	field, _ := m["field"].(string)
+	if !ok || len(m) != 1 || field == "" {
+		d.unsupported(path, "expected a single field")
+		return nil
+	}
+	return d.condition(path, field, NEQ, &NullLiteral{})
+}
+
+// fieldQuery returns the field and options of a query such as
+// `{"field": options}`.
+func (d *decompiler) fieldQuery(path string, v interface{}) (string, interface{}, bool) {
+	m, ok := v.(map[string]interface{})
+	if !ok || len(m) != 1 {
+		d.unsupported(path, "expected a single field")
+		return "", nil, false
+	}
+	for field, opts := range m {
+		return field, opts, true
+	}
+	return "", nil, false
+}
+
+// queryValue returns the value of a leaf query given either directly or
+// as `{"value": v}`.
+func (d *decompiler) queryValue(path string, v interface{}) (interface{}, bool) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return v, true
+	}
+	for _, key := range objectKeys(m) {
+		if key != "value" {
+			d.unsupported(path+"."+key, "no DSL equivalent")
+		}
+	}
+	value, ok := m["value"]
+	if !ok {
+		d.unsupported(path, "missing value")
+	}
+	return value, ok
+}
+
+// condition returns a condition on field qualified with the index, or nil
+// if the field cannot be written in a statement.
+func (d *decompiler) condition(path, field string, op Token, lit Literal) Expr {
+	if !parsesAs(field, (*Parser).parseFieldPath) {
+		d.unsupported(path, fmt.Sprintf("field %q cannot be written in the DSL", field))
+		return nil
+	}
+	return &Condition{Index: d.index, Field: field, Op: op, Value: lit}
+}
+
+// source adds the projection list for `_source` filtering.
+func (d *decompiler) source(path string, v interface{}) {
+	switch v := v.(type) {
+	case bool:
+		d.sourceOff = !v
+	case string, []interface{}:
+		d.fields(path, v, false)
+	case map[string]interface{}:
+		// Includes are listed before excludes, as they are usually written.
+		for _, key := range []string{"includes", "include", "excludes", "exclude"} {
+			if p, ok := v[key]; ok {
+				d.fields(path+"."+key, p, strings.HasPrefix(key, "exclude"))
+			}
+		}
+		for _, key := range objectKeys(v) {
+			switch key {
+			case "includes", "include", "excludes", "exclude":
+			default:
+				d.unsupported(path+"."+key, "no DSL equivalent")
+			}
+		}
+	default:
+		d.unsupported(path, "expected a boolean, pattern list or object")
+	}
+}
+
+// fields adds the projection items for a list of `_source` patterns.
+func (d *decompiler) fields(path string, v interface{}, exclude bool) {
+	for i, p := range jsonArray(v) {
+		pattern, ok := p.(string)
+		if !ok || !parsesAs(pattern, (*Parser).parseFieldPattern) {
+			d.unsupported(fmt.Sprintf("%s[%d]", path, i), fmt.Sprintf("pattern %v cannot be written in the DSL", p))
+			continue
+		}
+		d.stmt.Fields = append(d.stmt.Fields, &Field{Pattern: pattern, Exclude: exclude})
+	}
+}
+
+// docValues adds DOCVALUE items for `docvalue_fields`.
+func (d *decompiler) docValues(path string, v interface{}) {
+	for i, f := range jsonArray(v) {
+		path := fmt.Sprintf("%s[%d]", path, i)
+		if m, ok := f.(map[string]interface{}); ok {
+			for _, key := range objectKeys(m) {
+				if key != "field" {
+					d.unsupported(path+"."+key, "no DSL equivalent")
+				}
+			}
+			f = m["field"]
+		}
+		pattern, ok := f.(string)
+		if !ok || !parsesAs(pattern, (*Parser).parseFieldPattern) {
+			d.unsupported(path, fmt.Sprintf("field %v cannot be written in the DSL", f))
+			continue
+		}
+		d.stmt.Fields = append(d.stmt.Fields, &Field{Pattern: pattern, DocValue: true})
+	}
+}
+
+// sort adds the ORDER keys for a `sort` value. Keys other than _score are
+// qualified with the index so dotted fields read back unchanged.
+func (d *decompiler) sort(path string, v interface{}) {
+	for i, s := range jsonArray(v) {
+		path := fmt.Sprintf("%s[%d]", path, i)
+		f := &SortField{}
+		switch s := s.(type) {
+		case string:
+			f.Field = s
+			f.Desc = s == "_score"
+		case map[string]interface{}:
+			if len(s) != 1 {
+				d.unsupported(path, "expected a single field")
+				continue
+			}
+			for field, opts := range s {
+				f.Field = field
+				f.Desc = field == "_score"
+				if !d.sortOptions(path+"."+field, f, opts) {
+					f = nil
+				}
+			}
+		default:
+			f = nil
+			d.unsupported(path, "expected a field or an object")
+		}
+		if f == nil {
+			continue
+		}
+
+		if !parsesAs(f.Field, (*Parser).parseFieldPath) {
+			d.unsupported(path, fmt.Sprintf("field %q cannot be written in the DSL", f.Field))
+			continue
+		}
+		if f.Field != "_score" {
+			f.Index = d.index
+		}
+		d.stmt.SortFields = append(d.stmt.SortFields, f)
+	}
+}
+
+// sortOptions sets the order and missing values of a sort key.
+func (d *decompiler) sortOptions(path string, f *SortField, opts interface{}) bool {
+	setOrder := func(path string, v interface{}) bool {
+		switch v {
+		case "asc":
+			f.Desc = false
+		case "desc":
+			f.Desc = true
+		default:
+			d.unsupported(path, fmt.Sprintf("unknown order %v", v))
+			return false
+		}
+		return true
+	}
+
+	if order, ok := opts.(string); ok {
+		return setOrder(path, order)
+	}
+	m, ok := opts.(map[string]interface{})
+	if !ok {
+		d.unsupported(path, "expected an order or an object")
+		return false
+	}
+	for _, key := range objectKeys(m) {
+		switch key {
+		case "order":
+			if !setOrder(path+"."+key, m[key]) {
+				return false
+			}
+		case "missing":
+			switch {
+			case f.Field == "_score":
+				d.unsupported(path+"."+key, "NULLS is not allowed on _score")
+			case m[key] == "_first":
+				f.Nulls = "FIRST"
+			case m[key] == "_last":
+				f.Nulls = "LAST"
+			default:
+				d.unsupported(path+"."+key, "only _first and _last can be written as NULLS")
+			}
+		default:
+			d.unsupported(path+"."+key, "no DSL equivalent")
+		}
+	}
+	return true
+}
+
+// andExpr returns the items ANDed from left to right, or nil if there are
+// none. Operands are parenthesized as the parser would produce them.
+func andExpr(items []Expr) Expr {
+	var expr Expr
+	for _, item := range items {
+		if expr == nil {
+			if b, ok := item.(*BinaryExpr); ok && b.Op == OR {
+				item = &ParenExpr{Expr: item}
+			}
+			expr = item
+			continue
+		}
+		if _, ok := item.(*BinaryExpr); ok {
+			item = &ParenExpr{Expr: item}
+		}
+		expr = &BinaryExpr{Op: AND, LHS: expr, RHS: item}
+	}
+	return expr
+}
+
+// orExpr returns the items ORed from left to right, or nil if there are
+// none.
+func orExpr(items []Expr) Expr {
+	var expr Expr
+	for _, item := range items {
+		if expr == nil {
+			expr = item
+			continue
+		}
+		if b, ok := item.(*BinaryExpr); ok && b.Op == OR {
+			item = &ParenExpr{Expr: item}
+		}
+		expr = &BinaryExpr{Op: OR, LHS: expr, RHS: item}
+	}
+	return expr
+}
+
+// negate returns the negation of expr. Equality conditions are flipped
+// rather than wrapped in NOT.
+func negate(expr Expr) Expr {
+	switch e := expr.(type) {
+	case *Condition:
+		switch e.Op {
+		case EQ:
+			return &Condition{Index: e.Index, Field: e.Field, Op: NEQ, Value: e.Value, Pos: e.Pos}
+		case NEQ:
+			return &Condition{Index: e.Index, Field: e.Field, Op: EQ, Value: e.Value, Pos: e.Pos}
+		}
+	case *BinaryExpr:
+		expr = &ParenExpr{Expr: expr}
+	}
+	return &NotExpr{Expr: expr}
+}
+
+// parsesAs returns true if parse consumes all of s and returns it
+// unchanged.
+func parsesAs(s string, parse func(*Parser) (string, error)) bool {
+	p := NewParser(strings.NewReader(s))
+	v, err := parse(p)
+	if err != nil || v != s {
+		return false
+	}
+	tok, _, _ := p.scan()
+	return tok == EOF
+}
+
+// unescapeWildcard reverses escapeWildcard. It returns false if s
+// contains an unescaped wildcard metacharacter.
+func unescapeWildcard(s string) (string, bool) {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '*', '?':
+			return "", false
+		case '\\':
+			if i+1 == len(s) {
+				return "", false
+			}
+			i++
+		}
+		buf.WriteByte(s[i])
+	}
+	return buf.String(), true
+}
+
+// jsonArray returns v as a list; Elasticsearch accepts a single value in
+// place of a one-item list.
+func jsonArray(v interface{}) []interface{} {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		return v
+	}
+	return []interface{}{v}
+}
+
+// jsonInt returns v as an int if it is an integer.
+func jsonInt(v interface{}) (int, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	i, err := strconv.Atoi(n.String())
+	return i, err == nil
+}
+
+// jsonLiteral returns the literal for a JSON string, number or boolean, or
+// nil for any other value.
+func jsonLiteral(v interface{}) Literal {
+	switch v := jsonValue(v).(type) {
+	case int64:
+		return &IntegerLiteral{Val: v}
+	case float64:
+		return &NumberLiteral{Val: v}
+	case string:
+		return &StringLiteral{Val: v}
+	case bool:
+		return &BooleanLiteral{Val: v}
+	}
+	return nil
+}
+
+// objectKeys returns the keys of m in sorted order.
+func objectKeys(m map[string]interface{}) []string {
+	a := make([]string, 0, len(m))
+	for k := range m {
+		a = append(a, k)
+	}
+	sort.Strings(a)
+	return a
+}
+
+// hasSourceField returns true if fields filter _source.
+func hasSourceField(fields []*Field) bool {
+	for _, f := range fields {
+		if !f.DocValue {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,232 @@
+package parser
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Ensure `_search` bodies decompile to the expected statements and report
+// the parts they drop.
+func TestDecompiler_Decompile(t *testing.T) {
+	var tests = []struct {
+		timeField   string
+		body        string
+		s           string
+		unsupported []string
+	}{
+		// Bool clauses.
+		{
+			body: `{"query": {"bool": {
+				"must": [{"term": {"status": 500}}],
+				"filter": {"range": {"@timestamp": {"gte": "now-1d", "lte": "now"}}},
+				"must_not": [{"term": {"host": "a"}}, {"range": {"ms": {"gt": 10}}}]
+			}}}`,
+			s: `LOOK (web'doc): CONDITION [web.status EQ 500, web.host NEQ "a", NOT web.ms GT 10] AT [now-1d - now]`,
+		},
+		{
+			body: `{"query": {"bool": {
+				"filter": [{"range": {"@timestamp": {"gte": "now-1d"}}}],
+				"should": [{"term": {"a": 1}}, {"bool": {"must": [{"term": {"b": 2}}, {"term": {"c": 3}}]}}],
+				"minimum_should_match": 1
+			}}}`,
+			s: `LOOK (web'doc): CONDITION [(web.a EQ 1 OR web.b EQ 2 AND web.c EQ 3)] AT [now-1d -]`,
+		},
+		{
+			body:        `{"query": {"bool": {"should": [{"term": {"a": 1}}, {"term": {"a": 2}}]}}}`,
+			s:           `LOOK (web'doc): CONDITION [(web.a EQ 1 OR web.a EQ 2)] AT [- now]`,
+			unsupported: []string{"query"},
+		},
+		{
+			body:        `{"query": {"bool": {"must": [{"term": {"a": 1}}], "should": [{"term": {"b": 2}}], "boost": 2}}}`,
+			s:           `LOOK (web'doc): CONDITION [web.a EQ 1] AT [- now]`,
+			unsupported: []string{"query.bool.should", "query.bool.boost", "query"},
+		},
+		{
+			body:        `{"query": {"bool": {"must": {"term": {"a": 1}}, "should": [{"term": {"b": 2}}], "minimum_should_match": "1"}}}`,
+			s:           `LOOK (web'doc): CONDITION [web.a EQ 1, web.b EQ 2] AT [- now]`,
+			unsupported: []string{"query"},
+		},
+		{
+			body:        `{"query": {"bool": {"must_not": [{"bool": {"should": [{"term": {"a": 1}}, {"term": {"b": 2}}]}}]}}}`,
+			s:           `LOOK (web'doc): CONDITION [NOT (web.a EQ 1 OR web.b EQ 2)] AT [- now]`,
+			unsupported: []string{"query"},
+		},
+
+		// Leaf queries.
+		{
+			body: `{"query": {"bool": {"must": [
+				{"term": {"host": {"value": "a"}}},
+				{"terms": {"code": [1, 2.5, "x", true]}},
+				{"prefix": {"path": "/api"}},
+				{"wildcard": {"file": "*.l\\*g"}},
+				{"range": {"@timestamp": {"gte": "2018-11-23T12:23:45Z", "lte": 1544703132000, "format": "strict_date_optional_time"}}}
+			]}}}`,
+			s: `LOOK (web'doc): CONDITION [web.host EQ "a", (web.code EQ 1 OR web.code EQ 2.5 OR web.code EQ "x" OR web.code EQ TRUE), web.path PF "/api", web.file SF ".l*g"] AT [2018.11.23:12.23.45 - 2018.12.13:12.12.12]`,
+		},
+		{
+			body: `{"query": {"bool": {"must": [
+				{"wildcard": {"file": "a*"}},
+				{"wildcard": {"file": "*a?"}},
+				{"term": {"host": {"value": "a", "boost": 2}}},
+				{"terms": {"code": {"index": "x"}}},
+				{"match": {"msg": "x"}},
+				{"term": {"bad field": 1}}
+			]}}}`,
+			s: `LOOK (web'doc): CONDITION [web.host EQ "a"] AT [- now]`,
+			unsupported: []string{
+				"query.bool.must[0].wildcard",
+				"query.bool.must[1].wildcard",
+				"query.bool.must[2].term.boost",
+				"query.bool.must[3].terms",
+				"query.bool.must[4].match",
+				"query.bool.must[5].term",
+				"query",
+			},
+		},
+
+		// Exists and missing fields.
+		{
+			body:        `{"query": {"bool": {"must": [{"exists": {"field": "a"}}], "must_not": [{"exists": {"field": "b"}}]}}}`,
+			s:           `LOOK (web'doc): CONDITION [web.a NEQ NULL, web.b EQ NULL] AT [- now]`,
+			unsupported: []string{"query"},
+		},
+
+		// Only a top-level range on the time field is lifted into the AT
+		// window.
+		{
+			body: `{"query": {"range": {"@timestamp": {"gte": "now-15m"}}}}`,
+			s:    `LOOK (web'doc): CONDITION [] AT [now-15m -]`,
+		},
+		{
+			body: `{"query": {"bool": {"must": [{"bool": {"filter": [{"range": {"@timestamp": {"gte": "now-1h", "lte": "now"}}}]}}]}}}`,
+			s:    `LOOK (web'doc): CONDITION [] AT [now-1h - now]`,
+		},
+		{
+			timeField:   "ts",
+			body:        `{"query": {"bool": {"should": [{"range": {"ts": {"gte": "now-1h"}}}, {"term": {"a": 1}}]}}}`,
+			s:           `LOOK (web'doc): CONDITION [(web.ts GTE "now-1h" OR web.a EQ 1)] AT [- now]`,
+			unsupported: []string{"query"},
+		},
+		{
+			timeField: "ts",
+			body:      `{"query": {"bool": {"must_not": [{"range": {"ts": {"lte": "now-1h"}}}], "filter": [{"range": {"ts": {"gte": "now-1d"}}}]}}}`,
+			s:         `LOOK (web'doc): CONDITION [NOT web.ts LTE "now-1h"] AT [now-1d -]`,
+		},
+		{
+			timeField: "ts",
+			body:      `{"query": {"bool": {"must": [{"range": {"ts": {"gte": "now-1d"}}}, {"range": {"ts": {"lte": "now-1h"}}}]}}}`,
+			s:         `LOOK (web'doc): CONDITION [web.ts LTE "now-1h"] AT [now-1d -]`,
+		},
+
+		// The default time field cannot be written as a condition.
+		{
+			body:        `{"query": {"bool": {"should": [{"range": {"@timestamp": {"gte": "now-1h"}}}, {"term": {"a": 1}}]}}}`,
+			s:           `LOOK (web'doc): CONDITION [web.a EQ 1] AT [- now]`,
+			unsupported: []string{"query.bool.should[0].range", "query"},
+		},
+		{
+			body: `{"query": {"range": {"@timestamp": {"gt": "now-1d", "lte": "2018-13-01"}}}}`,
+			s:    `LOOK (web'doc): CONDITION [] AT [- now]`,
+			unsupported: []string{
+				"query.range.gt",
+				"query.range.lte",
+				"query.range",
+				"query",
+			},
+		},
+
+		// Projections.
+		{
+			body:        `{"_source": {"includes": ["host", "http.*"], "excludes": ["body"]}, "docvalue_fields": ["ts", {"field": "ms", "format": "long"}]}`,
+			s:           `LOOK (web'doc): [host, http.*, -body, DOCVALUE(ts), DOCVALUE(ms)] CONDITION [] AT [- now]`,
+			unsupported: []string{"docvalue_fields[1].format", "query"},
+		},
+		{
+			body:        `{"_source": false, "docvalue_fields": ["ts"]}`,
+			s:           `LOOK (web'doc): [DOCVALUE(ts)] CONDITION [] AT [- now]`,
+			unsupported: []string{"query"},
+		},
+		{
+			body:        `{"_source": "host", "docvalue_fields": ["ts"]}`,
+			s:           `LOOK (web'doc): [host, DOCVALUE(ts)] CONDITION [] AT [- now]`,
+			unsupported: []string{"query"},
+		},
+		{
+			body:        `{"docvalue_fields": ["ts"]}`,
+			s:           `LOOK (web'doc): [*, DOCVALUE(ts)] CONDITION [] AT [- now]`,
+			unsupported: []string{"query"},
+		},
+		{
+			body:        `{"_source": false}`,
+			s:           `LOOK (web'doc): CONDITION [] AT [- now]`,
+			unsupported: []string{"_source", "query"},
+		},
+
+		// Sorting and paging.
+		{
+			body:        `{"sort": ["_score", "host", {"http.status": "desc"}, {"ms": {"order": "asc", "missing": "_last"}}], "size": 20, "from": 40}`,
+			s:           `LOOK (web'doc): CONDITION [] AT [- now] ORDER [_score DESC, web.host ASC, web.http.status DESC, web.ms ASC NULLS LAST] LIMIT 20 OFFSET 40`,
+			unsupported: []string{"query"},
+		},
+		{
+			body: `{"sort": [{"a": {"order": "up"}}, {"b": {"missing": 0}}, {"_score": {"missing": "_first"}}, {"c": {"mode": "max"}}, 1], "from": 5}`,
+			s:    `LOOK (web'doc): CONDITION [] AT [- now] ORDER [web.b ASC, _score DESC, web.c ASC] LIMIT 10 OFFSET 5`,
+			unsupported: []string{
+				"sort[0].a.order",
+				"sort[1].b.missing",
+				"sort[2]._score.missing",
+				"sort[3].c.mode",
+				"sort[4]",
+				"query",
+			},
+		},
+
+		// Other parts of the body.
+		{
+			body:        `{"query": {"match_all": {}}, "aggs": {}, "size": 0, "track_total_hits": true}`,
+			s:           `LOOK (web'doc): CONDITION [] AT [- now]`,
+			unsupported: []string{"aggs", "size", "track_total_hits", "query"},
+		},
+	}
+
+	for i, tt := range tests {
+		d := NewDecompiler()
+		if tt.timeField != "" {
+			d.TimeField = tt.timeField
+		}
+		stmt, issues, err := d.Decompile(&IndexRef{Name: "web", Type: "doc"}, []byte(tt.body))
+		if err != nil {
+			t.Errorf("%d. %s: unexpected error: %s", i, tt.body, err)
+			continue
+		}
+		if s := Format(stmt); s != tt.s {
+			t.Errorf("%d. %s: statement mismatch:\n\nexp=%s\n\ngot=%s\n\n", i, tt.body, tt.s, s)
+		} else if _, err := NewParser(strings.NewReader(s)).Parse(); err != nil {
+			t.Errorf("%d. %s: statement does not parse: %s", i, s, err)
+		}
+		var paths []string
+		for _, u := range issues {
+			paths = append(paths, u.Path)
+		}
+		if !reflect.DeepEqual(paths, tt.unsupported) {
+			t.Errorf("%d. %s: unsupported mismatch:\n\nexp=%q\n\ngot=%q\n\n", i, tt.body, tt.unsupported, paths)
+		}
+	}
+}
+
+// Ensure decompiling requires an index and a valid body.
+func TestDecompiler_Decompile_Err(t *testing.T) {
+	for i, tt := range []struct {
+		ref  *IndexRef
+		body string
+	}{
+		{ref: nil, body: `{}`},
+		{ref: &IndexRef{Name: "web"}, body: `{}`},
+		{ref: &IndexRef{Name: "web", Type: "doc"}, body: `{`},
+	} {
+		if _, _, err := NewDecompiler().Decompile(tt.ref, []byte(tt.body)); err == nil {
+			t.Errorf("%d. expected error", i)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package parser
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// formatTimeLayout is the layout of UTC bounds with whole seconds.
+// Other bounds are written as RFC 3339.
+const formatTimeLayout = "2006.01.02:15.04.05"
+
+// Format returns the canonical text of a statement. Keywords are upper
+// case, spacing is normalized, conditions are qualified with "." and
+// clauses appear in grammar order, so that parsing the result yields an
+// equal statement. Indices and conditions keep their order, since parsing
+// must give back the statement as it was; call Canonicalize first for text
+// that does not depend on it.
+func Format(stmt Statement) string {
+	var buf bytes.Buffer
+	switch stmt := stmt.(type) {
+	case *SelectStatement:
+		buf.WriteString("LOOK ")
+		formatIndices(&buf, stmt.Indices)
+		if len(stmt.Fields) > 0 || len(stmt.Metrics) > 0 {
+			buf.WriteString(" ")
+			formatFields(&buf, stmt.Fields, stmt.Metrics)
+		}
+		buf.WriteString(" ")
+		formatCondition(&buf, stmt.Where)
+		buf.WriteString(" ")
+		formatTimeRange(&buf, stmt.Time)
+		if stmt.Interval != "" {
+			buf.WriteString(" BUCKET BY ")
+			buf.WriteString(stmt.Interval)
+		}
+		if len(stmt.GroupBy) > 0 {
+			buf.WriteString(" GROUP BY [")
+			for i, ref := range stmt.GroupBy {
+				if i > 0 {
+					buf.WriteString(", ")
+				}
+				formatFieldRef(&buf, ref.Index, ref.Field)
+			}
+			buf.WriteString("]")
+		}
+		if len(stmt.SortFields) > 0 {
+			buf.WriteString(" ORDER ")
+			formatSortFields(&buf, stmt.SortFields)
+		}
+		if stmt.Limit > 0 {
+			buf.WriteString(" LIMIT ")
+			buf.WriteString(strconv.Itoa(stmt.Limit))
+		}
+		if stmt.Offset > 0 {
+			buf.WriteString(" OFFSET ")
+			buf.WriteString(strconv.Itoa(stmt.Offset))
+		}
+	case *CountStatement:
+		buf.WriteString("TOTAL ")
+		formatIndices(&buf, stmt.Indices)
+		buf.WriteString(" ")
+		formatCondition(&buf, stmt.Where)
+		buf.WriteString(" ")
+		formatTimeRange(&buf, stmt.Time)
+	case *RecentStatement:
+		buf.WriteString("RECENT ")
+		formatIndices(&buf, stmt.Indices)
+		buf.WriteString(" TOTAL [")
+		buf.WriteString(strconv.Itoa(stmt.Size))
+		buf.WriteString("] ")
+		formatTimeRange(&buf, stmt.Time)
+	}
+	return buf.String()
+}
+
+// Canonicalize rewrites stmt so that statements differing only in the
+// order of their index list or of their comma separated condition items
+// format to the same text, as needed for cache keys. It also clears
+// positions and converts absolute bounds to UTC. The statement must have
+// been analyzed, as Parse does, so that no qualifier refers to an index by
+// position.
+func Canonicalize(stmt Statement) {
+	normalize(stmt)
+	switch stmt := stmt.(type) {
+	case *SelectStatement:
+		sortIndices(stmt.Indices)
+		stmt.Where = sortItems(stmt.Where)
+	case *CountStatement:
+		sortIndices(stmt.Indices)
+		stmt.Where = sortItems(stmt.Where)
+	case *RecentStatement:
+		sortIndices(stmt.Indices)
+	}
+}
+
+// normalize clears the positions of stmt and converts its absolute bounds
+// to UTC, as parsed zone offsets are distinct *time.Location values.
+func normalize(stmt Statement) {
+	var tr *TimeRange
+	switch stmt := stmt.(type) {
+	case *SelectStatement:
+		tr = stmt.Time
+		for _, cond := range Conditions(stmt.Where) {
+			cond.Pos = Pos{}
+		}
+		for _, ref := range stmt.GroupBy {
+			ref.Pos = Pos{}
+		}
+		for _, f := range stmt.SortFields {
+			f.Pos = Pos{}
+		}
+		for _, m := range stmt.Metrics {
+			m.Pos = Pos{}
+		}
+	case *CountStatement:
+		tr = stmt.Time
+		for _, cond := range Conditions(stmt.Where) {
+			cond.Pos = Pos{}
+		}
+	case *RecentStatement:
+		tr = stmt.Time
+	}
+	if tr == nil {
+		return
+	}
+	for _, b := range []*TimeBound{tr.Begin, tr.End} {
+		if b != nil && !b.IsMath() {
+			b.Time = b.Time.UTC()
+		}
+	}
+}
+
+// sortIndices sorts an index list by name and type.
+func sortIndices(refs []*IndexRef) {
+	sort.SliceStable(refs, func(i, j int) bool {
+		if refs[i].Name != refs[j].Name {
+			return refs[i].Name < refs[j].Name
+		}
+		return refs[i].Type < refs[j].Type
+	})
+}
+
+// sortItems returns expr with its comma separated items sorted by their
+// text. The result is the left-leaning AND chain the parser builds.
+func sortItems(expr Expr) Expr {
+	if expr == nil {
+		return nil
+	}
+
+	var items []Expr
+	for {
+		bin, ok := expr.(*BinaryExpr)
+		if !ok || bin.Op != AND {
+			break
+		}
+		items = append(items, bin.RHS)
+		expr = bin.LHS
+	}
+	items = append(items, expr)
+
+	keys := make(map[Expr]string, len(items))
+	for _, item := range items {
+		var buf bytes.Buffer
+		formatOrExpr(&buf, item)
+		keys[item] = buf.String()
+	}
+	sort.SliceStable(items, func(i, j int) bool { return keys[items[i]] < keys[items[j]] })
+
+	expr = items[0]
+	for _, item := range items[1:] {
+		expr = &BinaryExpr{Op: AND, LHS: expr, RHS: item}
+	}
+	return expr
+}
+
+// formatIndices writes an index list such as `(web'doc, app'doc):`.
+func formatIndices(buf *bytes.Buffer, refs []*IndexRef) {
+	buf.WriteString("(")
+	for i, ref := range refs {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(ref.Name)
+		if ref.Type != "" {
+			buf.WriteString("'")
+			buf.WriteString(ref.Type)
+		}
+	}
+	buf.WriteString("):")
+}
+
+// formatFields writes a projection list, fields first and metrics last.
+func formatFields(buf *bytes.Buffer, fields []*Field, metrics []*Metric) {
+	buf.WriteString("[")
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		switch {
+		case f.DocValue:
+			buf.WriteString("DOCVALUE(")
+			buf.WriteString(f.Pattern)
+			buf.WriteString(")")
+		case f.Exclude:
+			buf.WriteString("-")
+			buf.WriteString(f.Pattern)
+		default:
+			buf.WriteString(f.Pattern)
+		}
+	}
+	for i, m := range metrics {
+		if i > 0 || len(fields) > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(m.Func)
+		buf.WriteString("(")
+		formatFieldRef(buf, m.Index, m.Field)
+		buf.WriteString(")")
+	}
+	buf.WriteString("]")
+}
+
+// formatCondition writes a CONDITION clause. The top-level AND chain is
+// written as comma separated items.
+func formatCondition(buf *bytes.Buffer, expr Expr) {
+	buf.WriteString("CONDITION [")
+	if expr != nil {
+		formatItems(buf, expr)
+	}
+	buf.WriteString("]")
+}
+
+// formatItems writes expr as comma separated items.
+func formatItems(buf *bytes.Buffer, expr Expr) {
+	if expr, ok := expr.(*BinaryExpr); ok && expr.Op == AND {
+		formatItems(buf, expr.LHS)
+		buf.WriteString(", ")
+		formatOrExpr(buf, expr.RHS)
+		return
+	}
+	formatOrExpr(buf, expr)
+}
+
+// formatOrExpr writes an expression at OR precedence.
+func formatOrExpr(buf *bytes.Buffer, expr Expr) {
+	if expr, ok := expr.(*BinaryExpr); ok && expr.Op == OR {
+		formatOrExpr(buf, expr.LHS)
+		buf.WriteString(" OR ")
+		formatAndExpr(buf, expr.RHS)
+		return
+	}
+	formatAndExpr(buf, expr)
+}
+
+// formatAndExpr writes an expression at AND precedence.
+func formatAndExpr(buf *bytes.Buffer, expr Expr) {
+	if expr, ok := expr.(*BinaryExpr); ok && expr.Op == AND {
+		formatAndExpr(buf, expr.LHS)
+		buf.WriteString(" AND ")
+		formatUnaryExpr(buf, expr.RHS)
+		return
+	}
+	formatUnaryExpr(buf, expr)
+}
+
+// formatUnaryExpr writes a NOT, parenthesized or condition expression.
+// Binary expressions that reach this level are parenthesized.
+func formatUnaryExpr(buf *bytes.Buffer, expr Expr) {
+	switch expr := expr.(type) {
+	case *NotExpr:
+		buf.WriteString("NOT ")
+		formatUnaryExpr(buf, expr.Expr)
+	case *ParenExpr:
+		buf.WriteString("(")
+		formatOrExpr(buf, expr.Expr)
+		buf.WriteString(")")
+	case *BinaryExpr:
+		buf.WriteString("(")
+		formatOrExpr(buf, expr)
+		buf.WriteString(")")
+	case *Condition:
+		if expr.Index == "" {
+			buf.WriteString("*")
+		}
+		buf.WriteString(expr.Index)
+		buf.WriteString(".")
+		buf.WriteString(expr.Field)
+		buf.WriteString(" ")
+		buf.WriteString(expr.Op.String())
+		buf.WriteString(" ")
+		buf.WriteString(expr.Value.String())
+	}
+}
+
+// formatTimeRange writes an AT clause.
+func formatTimeRange(buf *bytes.Buffer, tr *TimeRange) {
+	buf.WriteString("AT [")
+	if tr != nil {
+		if tr.Begin != nil {
+			buf.WriteString(formatTimeBound(tr.Begin))
+			buf.WriteString(" ")
+		}
+		buf.WriteString("-")
+		if tr.End != nil {
+			buf.WriteString(" ")
+			buf.WriteString(formatTimeBound(tr.End))
+		}
+	}
+	buf.WriteString("]")
+}
+
+// formatTimeBound returns the text of a time bound.
+func formatTimeBound(b *TimeBound) string {
+	if b.IsMath() {
+		return b.Math
+	}
+	if b.Time.Location() == time.UTC && b.Time.Nanosecond() == 0 {
+		return b.Time.Format(formatTimeLayout)
+	}
+	return b.Time.Format(time.RFC3339Nano)
+}
+
+// formatSortFields writes the list of an ORDER clause.
+func formatSortFields(buf *bytes.Buffer, fields []*SortField) {
+	buf.WriteString("[")
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		formatFieldRef(buf, f.Index, f.Field)
+		if f.Desc {
+			buf.WriteString(" DESC")
+		} else {
+			buf.WriteString(" ASC")
+		}
+		if f.Nulls != "" {
+			buf.WriteString(" NULLS ")
+			buf.WriteString(f.Nulls)
+		}
+	}
+	buf.WriteString("]")
+}
+
+// formatFieldRef writes an optionally index-qualified field.
+func formatFieldRef(buf *bytes.Buffer, index, field string) {
+	if index != "" {
+		buf.WriteString(index)
+		buf.WriteString(".")
+	}
+	buf.WriteString(field)
+}
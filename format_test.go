@@ -0,0 +1,192 @@
+package parser
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Ensure statements format to canonical text that parses back to an equal
+// statement.
+func TestFormat(t *testing.T) {
+	var tests = []struct {
+		s   string
+		out string
+	}{
+		// Keyword case and spacing.
+		{
+			s:   `look (web'doc) : condition [ web.status eq 500 ]  at [now-1d - now]`,
+			out: `LOOK (web'doc): CONDITION [web.status EQ 500] AT [now-1d - now]`,
+		},
+
+		// Qualifiers by position or in another case resolve to the index name.
+		{
+			s:   `LOOK (web'doc, App'log): CONDITION [1'status GT 400, app.level NEQ "debug"] AT [now-1h - now]`,
+			out: `LOOK (web'doc, App'log): CONDITION [web.status GT 400, App.level NEQ "debug"] AT [now-1h - now]`,
+		},
+
+		// A top-level AND is written as items, nested expressions keep their
+		// structure.
+		{
+			s:   `LOOK (web'doc): CONDITION [NOT (web.a EQ 1 OR web.b EQ 2) AND web.c PF "x", web.d EQ NULL OR web.e SF "y"] AT [now-1d - now]`,
+			out: `LOOK (web'doc): CONDITION [NOT (web.a EQ 1 OR web.b EQ 2), web.c PF "x", web.d EQ NULL OR web.e SF "y"] AT [now-1d - now]`,
+		},
+
+		// Projections, aggregations, sorting and paging.
+		{
+			s:   `LOOK (web'doc): [host, -body, DOCVALUE(ts), COUNT(web.id)] CONDITION [] AT [now-7d/d - now/d] BUCKET BY 1h GROUP BY [web.host] ORDER [web.ts DESC NULLS LAST] LIMIT 10 OFFSET 20`,
+			out: `LOOK (web'doc): [host, -body, DOCVALUE(ts), COUNT(web.id)] CONDITION [] AT [now-7d/d - now/d] BUCKET BY 1h GROUP BY [web.host] ORDER [web.ts DESC NULLS LAST] LIMIT 10 OFFSET 20`,
+		},
+
+		// Dotted fields that do not start with an index stay unqualified.
+		{
+			s:   `LOOK (web'doc): CONDITION [] AT [now-1d - now] ORDER [http.status]`,
+			out: `LOOK (web'doc): CONDITION [] AT [now-1d - now] ORDER [http.status ASC]`,
+		},
+
+		// Unqualified SQL fields apply to every index.
+		{
+			s:   `SELECT * FROM web'doc, app'log WHERE status = 500 AND app.level <> 'debug' AND @timestamp BETWEEN 'now-1h' AND 'now' ORDER BY bytes DESC`,
+			out: `LOOK (web'doc, app'log): CONDITION [*.status EQ 500, app.level NEQ "debug"] AT [now-1h - now] ORDER [bytes DESC]`,
+		},
+
+		// Types are optional.
+		{
+			s:   `SELECT * FROM web, app'log WHERE status = 500 AND @timestamp BETWEEN 'now-1h' AND 'now'`,
+			out: `LOOK (web, app'log): CONDITION [*.status EQ 500] AT [now-1h - now]`,
+		},
+
+		// Keywords are names after a "." and at the start of a projection.
+		{
+			s:   `LOOK (mail'doc): [from, -limit.x, DOCVALUE(order)] CONDITION [mail.from EQ "a@b", mail'order.id GT 1] AT [now-1d - now] GROUP BY [x.user.group] ORDER [x.order.id DESC]`,
+			out: `LOOK (mail'doc): [from, -limit.x, DOCVALUE(order)] CONDITION [mail.from EQ "a@b", mail.order.id GT 1] AT [now-1d - now] GROUP BY [x.user.group] ORDER [x.order.id DESC]`,
+		},
+		{
+			s:   `SELECT mail.from FROM mail'doc WHERE x.order.id = 1 AND @timestamp BETWEEN 'now-1h' AND 'now' GROUP BY x.user.group`,
+			out: `LOOK (mail'doc): [from] CONDITION [*.x.order.id EQ 1] AT [now-1h - now] GROUP BY [x.user.group]`,
+		},
+
+		// Absolute bounds.
+		{
+			s:   `LOOK (web'doc): CONDITION [] AT [2018.11.23:12.23.45 - 2018-12-13T12:12:12.5+08:00]`,
+			out: `LOOK (web'doc): CONDITION [] AT [2018.11.23:12.23.45 - 2018-12-13T12:12:12.5+08:00]`,
+		},
+
+		// Open ended windows.
+		{
+			s:   `TOTAL (web'doc): CONDITION [web.x GTE 1.5] AT [now-1d -]`,
+			out: `TOTAL (web'doc): CONDITION [web.x GTE 1.5] AT [now-1d -]`,
+		},
+		{
+			s:   `RECENT (web'doc, app'log): TOTAL [100] AT [- now]`,
+			out: `RECENT (web'doc, app'log): TOTAL [100] AT [- now]`,
+		},
+	}
+
+	for i, tt := range tests {
+		stmt, err := NewParser(strings.NewReader(tt.s)).Parse()
+		if err != nil {
+			t.Errorf("%d. %q: parse error: %s", i, tt.s, err)
+			continue
+		}
+		if out := Format(stmt); out != tt.out {
+			t.Errorf("%d. %q: format mismatch:\n\nexp=%s\n\ngot=%s\n\n", i, tt.s, tt.out, out)
+			continue
+		}
+		testRoundTrip(t, tt.s)
+	}
+}
+
+// Ensure statements differing in the order of their indices or condition
+// items have the same canonical text.
+func TestCanonicalize(t *testing.T) {
+	var tests = []struct {
+		a, b string
+		out  string
+	}{
+		{
+			a:   `LOOK (web'doc, app'log): CONDITION [web.b EQ 2, app.a EQ 1, web.a EQ 1 OR web.c EQ 3] AT [now-1d - now]`,
+			b:   `LOOK (app'log, web'doc): CONDITION [web.a EQ 1 OR web.c EQ 3, web.b EQ 2, app.a EQ 1] AT [now-1d - now]`,
+			out: `LOOK (app'log, web'doc): CONDITION [app.a EQ 1, web.a EQ 1 OR web.c EQ 3, web.b EQ 2] AT [now-1d - now]`,
+		},
+
+		// Positions resolve to names before the indices are sorted.
+		{
+			a:   `TOTAL (web'doc, app'log): CONDITION [1.a EQ 1, 2.b EQ 2] AT [now-1d - now]`,
+			b:   `TOTAL (app'log, web'doc): CONDITION [1.b EQ 2, 2.a EQ 1] AT [now-1d - now]`,
+			out: `TOTAL (app'log, web'doc): CONDITION [app.b EQ 2, web.a EQ 1] AT [now-1d - now]`,
+		},
+
+		// Absolute bounds are written in UTC.
+		{
+			a:   `LOOK (web'doc): CONDITION [] AT [2018-11-23T20:23:45+08:00 -]`,
+			b:   `LOOK (web'doc): CONDITION [] AT [2018.11.23:12.23.45 -]`,
+			out: `LOOK (web'doc): CONDITION [] AT [2018.11.23:12.23.45 -]`,
+		},
+	}
+
+	for i, tt := range tests {
+		for _, s := range []string{tt.a, tt.b} {
+			stmt, err := NewParser(strings.NewReader(s)).Parse()
+			if err != nil {
+				t.Errorf("%d. %q: parse error: %s", i, s, err)
+				continue
+			}
+			Canonicalize(stmt)
+			if out := Format(stmt); out != tt.out {
+				t.Errorf("%d. %q: canonical text mismatch:\n\nexp=%s\n\ngot=%s\n\n", i, s, tt.out, out)
+			}
+		}
+		testRoundTrip(t, tt.out)
+	}
+}
+
+// FuzzFormat checks that any statement that parses formats to text that
+// parses back to an equal statement.
+func FuzzFormat(f *testing.F) {
+	for _, s := range []string{
+		`LOOK (web'doc): CONDITION [web.status EQ 500] AT [now-1d - now]`,
+		`LOOK (web'doc, app'log): CONDITION [NOT (1.a EQ 1 OR 2.b NEQ "x"), web.c EQ NULL] AT [2018.11.23:12.23.45 -]`,
+		`LOOK (web'doc): [host, -body, DOCVALUE(ts), SUM(web.bytes)] CONDITION [] AT [now-7d/d - now/d] BUCKET BY 1h GROUP BY [web.host] ORDER [http.status DESC] LIMIT 10 OFFSET 20`,
+		`TOTAL (web'doc): CONDITION [web.x GTE 1.5, web.y PF "a"] AT [- now]`,
+		`RECENT (web'doc): TOTAL [100] AT [2018-12-13T12:12:12.5+08:00 - now]`,
+		`SELECT host, COUNT(*) FROM web'doc WHERE status >= 500 AND @timestamp BETWEEN 'now-1d' AND 'now' GROUP BY host`,
+		`LOOK (mail'doc): [from] CONDITION [mail.from EQ "a@b"] AT [- now] ORDER [x.order.id]`,
+	} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		if _, err := NewParser(strings.NewReader(s)).Parse(); err != nil {
+			return
+		}
+		testRoundTrip(t, s)
+	})
+}
+
+// testRoundTrip checks that s formats to text that parses back to an equal
+// statement, both as written and in canonical form.
+func testRoundTrip(t *testing.T, s string) {
+	t.Helper()
+	for _, canonical := range []bool{false, true} {
+		stmt, err := NewParser(strings.NewReader(s)).Parse()
+		if err != nil {
+			t.Fatalf("%q: parse error: %s", s, err)
+		}
+		if canonical {
+			Canonicalize(stmt)
+		}
+		text := Format(stmt)
+		other, err := NewParser(strings.NewReader(text)).Parse()
+		if err != nil {
+			t.Fatalf("%q: formatted statement does not parse: %s: %s", s, text, err)
+		}
+		if again := Format(other); again != text {
+			t.Fatalf("%q: format is not stable:\n\nexp=%s\n\ngot=%s\n\n", s, text, again)
+		}
+		normalize(stmt)
+		normalize(other)
+		if !reflect.DeepEqual(stmt, other) {
+			t.Fatalf("%q: formatted statement parses differently: %s", s, text)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+//go:build gofuzz
+// +build gofuzz
+
+package parser
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// Fuzz is the go-fuzz entry point. Parsing and compiling arbitrary input
+// must either succeed or return an error; any panic is a bug.
+func Fuzz(data []byte) int {
+	stmt, err := NewParser(bytes.NewReader(data)).Parse()
+	if err != nil {
+		if _, ok := err.(*ParseError); !ok {
+			panic("non-ParseError returned from Parse: " + err.Error())
+		}
+		return 0
+	}
+	if _, err := NewCompiler().Compile(stmt); err != nil {
+		return 0
+	}
+	return 1
+}
+
+// FuzzRoundTrip checks that formatting is a round trip: any statement that
+// parses must format to text that parses back to an equal statement, and
+// formatting that statement again must give the same text. The native
+// FuzzFormat test checks the same property with `go test -fuzz`.
+func FuzzRoundTrip(data []byte) int {
+	stmt, err := NewParser(bytes.NewReader(data)).Parse()
+	if err != nil {
+		return 0
+	}
+	text := Format(stmt)
+	other, err := NewParser(strings.NewReader(text)).Parse()
+	if err != nil {
+		panic("formatted statement does not parse: " + text + ": " + err.Error())
+	}
+	if again := Format(other); again != text {
+		panic("format is not stable: " + text + " != " + again)
+	}
+	normalize(stmt)
+	normalize(other)
+	if !reflect.DeepEqual(stmt, other) {
+		panic("formatted statement parses differently: " + text)
+	}
+	return 1
+}
+
+// FuzzScript checks that Next always makes progress, that the spans it
+// returns are in order within the input, and that the source of each
+// statement parses on its own to an equal statement.
+func FuzzScript(data []byte) int {
+	src := string(data)
+	p := NewParser(strings.NewReader(src))
+	last := 0
+	for i := 0; ; i++ {
+		if i > len(src) {
+			panic("Next does not make progress")
+		}
+		stmt, span, err := p.Next()
+		if err == io.EOF {
+			return 1
+		}
+		if span.Start.Offset < last || span.End.Offset <= span.Start.Offset || span.End.Offset > len(src) {
+			panic("span out of order")
+		}
+		last = span.End.Offset
+		if err != nil {
+			continue
+		}
+
+		other, err := NewParser(strings.NewReader(span.Source(src))).Parse()
+		if err != nil {
+			panic("statement source does not parse: " + span.Source(src) + ": " + err.Error())
+		}
+		normalize(stmt)
+		normalize(other)
+		if !reflect.DeepEqual(stmt, other) {
+			panic("statement source parses differently: " + span.Source(src))
+		}
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/Maary/elastic_search_parser
+
+go 1.21
@@ -0,0 +1,98 @@
+package parser
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Literal represents a condition value.
+type Literal interface {
+	literal()
+
+	// String returns the literal as it is written in a statement.
+	String() string
+
+	// Value returns the literal as a Go value suitable for JSON encoding.
+	Value() interface{}
+}
+
+// IntegerLiteral represents an integer literal.
+type IntegerLiteral struct {
+	Val int64
+}
+
+// NumberLiteral represents a floating-point literal.
+type NumberLiteral struct {
+	Val float64
+}
+
+// StringLiteral represents a string literal.
+type StringLiteral struct {
+	Val string
+}
+
+// BooleanLiteral represents a TRUE or FALSE literal.
+type BooleanLiteral struct {
+	Val bool
+}
+
+// NullLiteral represents the NULL literal.
+type NullLiteral struct{}
+
+func (*IntegerLiteral) literal() {}
+func (*NumberLiteral) literal()  {}
+func (*StringLiteral) literal()  {}
+func (*BooleanLiteral) literal() {}
+func (*NullLiteral) literal()    {}
+
+// String returns the literal as it is written in a statement.
+func (l *IntegerLiteral) String() string { return strconv.FormatInt(l.Val, 10) }
+
+// String returns the literal as it is written in a statement. The result
+// always contains a "." or an exponent so it is read back as a number
+// rather than an integer.
+func (l *NumberLiteral) String() string {
+	s := strconv.FormatFloat(l.Val, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s
+}
+
+// String returns the literal as it is written in a statement.
+func (l *StringLiteral) String() string { return strconv.Quote(l.Val) }
+
+// String returns the literal as it is written in a statement.
+func (l *BooleanLiteral) String() string {
+	if l.Val {
+		return "TRUE"
+	}
+	return "FALSE"
+}
+
+// String returns the literal as it is written in a statement.
+func (l *NullLiteral) String() string { return "NULL" }
+
+// Value returns the literal as a Go value.
+func (l *IntegerLiteral) Value() interface{} { return l.Val }
+
+// Value returns the literal as a Go value.
+func (l *NumberLiteral) Value() interface{} { return l.Val }
+
+// Value returns the literal as a Go value.
+func (l *StringLiteral) Value() interface{} { return l.Val }
+
+// Value returns the literal as a Go value.
+func (l *BooleanLiteral) Value() interface{} { return l.Val }
+
+// Value returns the literal as a Go value.
+func (l *NullLiteral) Value() interface{} { return nil }
+
+// isNumeric returns true if lit is an integer or floating-point literal.
+func isNumeric(lit Literal) bool {
+	switch lit.(type) {
+	case *IntegerLiteral, *NumberLiteral:
+		return true
+	}
+	return false
+}
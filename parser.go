@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Token represents a lexical token.
@@ -16,7 +18,12 @@ const (
 	WS
 
 	// Literals
-	IDENT // main
+	IDENT     // main
+	INTEGER   // 12345
+	NUMBER    // 123.45, 1e-3
+	STRING    // "abc" or 'abc'
+	BADSTRING // "abc
+	BADESCAPE // \q
 
 	// Misc characters
 	OWN        // '
@@ -29,13 +36,23 @@ const (
 	MParLeft   // [
 	MParRight  // ]
 	Point      //.
-	STR        //"
 	MIDEND     //-
 	PointRight //>
+	PLUS       //+
+	SLASH      ///
+	ASTERISK   //*
+	EQSIGN     //=
+	NEQSIGN    //!= or <>
+	LTSIGN     //<
+	LTESIGN    //<=
+	GTESIGN    //>=
+	SEMICOLON  //;
 
 	// Keywords
+	keywordBeg
 	LOOK
 	TOTAL
+	RECENT
 	CONDITION
 	AT
 	EQ
@@ -46,618 +63,1242 @@ const (
 	GTE
 	LT
 	LTE
+	AND
+	OR
+	NOT
+	TRUE
+	FALSE
+	NULL
+	DOCVALUE
+	ORDER
+	ASC
+	DESC
+	NULLS
+	LIMIT
+	OFFSET
+	GROUP
+	BY
+	BUCKET
+	EVERY
+	SELECT
+	FROM
+	WHERE
+	BETWEEN
+	LIKE
+	keywordEnd
 )
 
-// SelectStatement represents a SQL SELECT statement.
-type SelectStatement struct {
-	IndexToTypeSet  []map[string]string
-	IndexToFieldSet []map[string]*Operation
-	TimeBegin       string
-	TimeEnd         string
+// tokens maps each token to its text.
+var tokens = map[Token]string{
+	ILLEGAL: "ILLEGAL",
+	EOF:     "EOF",
+	WS:      "WS",
+	IDENT:   "IDENT",
+
+	INTEGER:   "INTEGER",
+	NUMBER:    "NUMBER",
+	STRING:    "STRING",
+	BADSTRING: "BADSTRING",
+	BADESCAPE: "BADESCAPE",
+
+	OWN:        "'",
+	COMMA:      ",",
+	ParLeft:    "(",
+	ParRight:   ")",
+	IS:         ":",
+	BParLeft:   "{",
+	BParRight:  "}",
+	MParLeft:   "[",
+	MParRight:  "]",
+	Point:      ".",
+	MIDEND:     "-",
+	PointRight: ">",
+	PLUS:       "+",
+	SLASH:      "/",
+	ASTERISK:   "*",
+	EQSIGN:     "=",
+	NEQSIGN:    "!=",
+	LTSIGN:     "<",
+	LTESIGN:    "<=",
+	GTESIGN:    ">=",
+	SEMICOLON:  ";",
+
+	LOOK:      "LOOK",
+	TOTAL:     "TOTAL",
+	RECENT:    "RECENT",
+	CONDITION: "CONDITION",
+	AT:        "AT",
+	EQ:        "EQ",
+	NEQ:       "NEQ",
+	PF:        "PF",
+	SF:        "SF",
+	GT:        "GT",
+	GTE:       "GTE",
+	LT:        "LT",
+	LTE:       "LTE",
+	AND:       "AND",
+	OR:        "OR",
+	NOT:       "NOT",
+	TRUE:      "TRUE",
+	FALSE:     "FALSE",
+	NULL:      "NULL",
+	DOCVALUE:  "DOCVALUE",
+	ORDER:     "ORDER",
+	ASC:       "ASC",
+	DESC:      "DESC",
+	NULLS:     "NULLS",
+	LIMIT:     "LIMIT",
+	OFFSET:    "OFFSET",
+	GROUP:     "GROUP",
+	BY:        "BY",
+	BUCKET:    "BUCKET",
+	EVERY:     "EVERY",
+	SELECT:    "SELECT",
+	FROM:      "FROM",
+	WHERE:     "WHERE",
+	BETWEEN:   "BETWEEN",
+	LIKE:      "LIKE",
+}
+
+// String returns the string representation of the token.
+func (tok Token) String() string {
+	if s, ok := tokens[tok]; ok {
+		return s
+	}
+	return strconv.Itoa(int(tok))
 }
 
-type Operation struct {
-	FieldName string
-	Opt       string
-	Value     interface{}
-	ValueType string
+// Pos specifies the position of a token in the input.
+// Line and Column are 1-based; Offset is the 0-based byte offset.
+type Pos struct {
+	Line   int
+	Column int
+	Offset int
+}
+
+// Span represents the source range of a statement. End is the position
+// just after its last token.
+type Span struct {
+	Start Pos
+	End   Pos
+}
+
+// Source returns the text of the span within src.
+func (s Span) Source(src string) string {
+	return src[s.Start.Offset:s.End.Offset]
+}
+
+// ParseError represents an error that occurred during parsing.
+type ParseError struct {
+	Message  string
+	Found    string
+	Expected []string
+	Pos      Pos
+}
+
+// newParseError returns a new instance of ParseError.
+func newParseError(found string, expected []string, pos Pos) *ParseError {
+	return &ParseError{Found: found, Expected: expected, Pos: pos}
+}
+
+// Error returns the string representation of the error.
+func (e *ParseError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%s at line %d, char %d", e.Message, e.Pos.Line, e.Pos.Column)
+	}
+	found := e.Found
+	if found == "" {
+		found = "EOF"
+	}
+	return fmt.Sprintf("found %q, expected %s at line %d, char %d", found, strings.Join(e.Expected, ", "), e.Pos.Line, e.Pos.Column)
+}
+
+// DefaultTimeLayouts are the layouts accepted for AT bounds by default.
+var DefaultTimeLayouts = []string{
+	"2006.01.02:15.04.05",
+	"2006.01.02:15.04",
+	"2006.01.02",
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02",
 }
 
 // Parser represents a parser.
 type Parser struct {
+	// TimeLayouts are the layouts tried, in order, for AT bounds.
+	// Bounds without a zone are read as UTC.
+	TimeLayouts []string
+
+	// Schema, when set, checks the conditions of parsed statements
+	// against the index mappings.
+	Schema *Schema
+
+	// timeField is the field whose SQL BETWEEN becomes the AT window. It
+	// follows the compiler's TimeField, see Compiler.NewParser.
+	timeField string
+
 	s   *Scanner
 	buf struct {
 		tok Token  // last read token
+		pos Pos    // last read pos
 		lit string // last read literal
+		end Pos    // position after the last read token
 		n   int    // buffer size (max=1)
 	}
+
+	// end is the position after the last token consumed other than
+	// whitespace, and prevEnd the one before it, restored by unscan.
+	end, prevEnd Pos
 }
 
 // NewParser returns a new instance of Parser.
 func NewParser(r io.Reader) *Parser {
-	return &Parser{s: NewScanner(r)}
+	return &Parser{s: NewScanner(r), TimeLayouts: DefaultTimeLayouts, timeField: DefaultTimeField}
 }
 
-// Parse parses a SQL SELECT statement.
-func (p *Parser) Parse() (*SelectStatement, error) {
-	indesToType := make(map[string]string)
-	stmt := &SelectStatement{}
+// Parse parses a LOOK, TOTAL, RECENT or SQL SELECT statement. The
+// statement is then analyzed so condition indices name declared indices.
+func (p *Parser) Parse() (Statement, error) {
+	stmt, err := p.parseStatement()
+	if err != nil {
+		return nil, err
+	}
+	if err := Analyze(stmt); err != nil {
+		return nil, err
+	}
+	if p.Schema != nil {
+		if err := p.Schema.Validate(stmt); err != nil {
+			return nil, err
+		}
+	}
+	return stmt, nil
+}
 
-	// First token should be a "SELECT" keyword.
-	tok, lit := p.scanIgnoreWhitespace()
-	if tok != LOOK && tok != TOTAL {
-		p.unscan()
-		return nil, fmt.Errorf("found %q, expected LOOK or TOTAL", lit)
+// Next parses the next statement of a script and returns it with its
+// source span. Statements are separated by `;` or by a blank line after a
+// complete statement. Next returns io.EOF when no statement is left.
+//
+// On error the rest of the statement is skipped, so the span covers the
+// failed statement and the following call continues with the next one.
+func (p *Parser) Next() (Statement, Span, error) {
+	// Skip separators before the statement.
+	tok, pos, _ := p.scan()
+	for tok == WS || tok == SEMICOLON {
+		tok, pos, _ = p.scan()
+	}
+	if tok == EOF {
+		return nil, Span{}, io.EOF
+	}
+	p.unscan()
+
+	span := Span{Start: pos}
+	stmt, err := p.Parse()
+	if err == nil {
+		span.End = p.end
+		if err = p.parseSeparator(); err == nil {
+			return stmt, span, nil
+		}
+	}
+	p.skipStatement(span.Start)
+	span.End = p.end
+	return nil, span, err
+}
+
+// ParseAll parses every statement of a script with Next. It stops at the
+// first error.
+func (p *Parser) ParseAll() ([]Statement, []Span, error) {
+	var stmts []Statement
+	var spans []Span
+	for {
+		stmt, span, err := p.Next()
+		if err == io.EOF {
+			return stmts, spans, nil
+		} else if err != nil {
+			return nil, nil, err
+		}
+		stmts = append(stmts, stmt)
+		spans = append(spans, span)
+	}
+}
+
+// parseSeparator parses the end of a statement: a `;`, a blank line or
+// EOF. Only the `;` is consumed.
+func (p *Parser) parseSeparator() error {
+	end := p.end
+	tok, pos, lit := p.scanIgnoreWhitespace()
+	if tok == SEMICOLON {
+		return nil
+	}
+	p.unscan()
+	if tok == EOF || pos.Line-end.Line > 1 {
+		return nil
+	}
+	return newParseError(lit, []string{";", "blank line", "EOF"}, pos)
+}
+
+// skipStatement skips the tokens of the statement starting at start up
+// to the next separator after an error.
+func (p *Parser) skipStatement(start Pos) {
+	for {
+		end := p.end
+		tok, pos, _ := p.scanIgnoreWhitespace()
+		switch {
+		case tok == SEMICOLON, tok == EOF:
+			p.unscan()
+			return
+		case pos.Offset > start.Offset && pos.Line-end.Line > 1:
+			p.unscan()
+			return
+		}
 	}
+}
+
+// parseStatement parses a single statement of any kind.
+func (p *Parser) parseStatement() (Statement, error) {
+	// First token should be a "LOOK", "TOTAL", "RECENT" or "SELECT" keyword.
+	tok, pos, lit := p.scanIgnoreWhitespace()
 	switch tok {
 	case LOOK:
-		{
+		return p.parseSelectStatement()
+	case TOTAL:
+		return p.parseCountStatement()
+	case RECENT:
+		return p.parseRecentStatement()
+	case SELECT:
+		return p.parseSQLSelectStatement()
+	}
+	p.unscan()
+	return nil, newParseError(lit, []string{"LOOK", "TOTAL", "RECENT", "SELECT"}, pos)
+}
 
-			tok, lit = p.scanIgnoreWhitespace()
-			if tok != ParLeft {
-				p.unscan()
-				return nil, fmt.Errorf("found %q, expected index_name", lit)
-			}
+// parseSelectStatement parses a LOOK statement.
+// This function assumes the LOOK token has already been consumed.
+func (p *Parser) parseSelectStatement() (*SelectStatement, error) {
+	stmt := &SelectStatement{}
+	var err error
+	if stmt.Indices, err = p.parseIndexList(); err != nil {
+		return nil, err
+	}
+	if tok, _, _ := p.scanIgnoreWhitespace(); tok == MParLeft {
+		p.unscan()
+		if stmt.Fields, stmt.Metrics, err = p.parseFields(stmt.Indices); err != nil {
+			return nil, err
+		}
+	} else {
+		p.unscan()
+	}
+	if stmt.Where, err = p.parseCondition(); err != nil {
+		return nil, err
+	}
+	if stmt.Time, err = p.parseTimeRange(); err != nil {
+		return nil, err
+	}
+	switch tok, _, _ := p.scanIgnoreWhitespace(); tok {
+	case BUCKET:
+		if err := p.expect(BY); err != nil {
+			return nil, err
+		}
+		fallthrough
+	case EVERY:
+		if stmt.Interval, err = p.parseInterval(); err != nil {
+			return nil, err
+		}
+	default:
+		p.unscan()
+	}
+	if tok, _, _ := p.scanIgnoreWhitespace(); tok == GROUP {
+		if stmt.GroupBy, err = p.parseGroupBy(stmt.Indices); err != nil {
+			return nil, err
+		}
+	} else {
+		p.unscan()
+	}
+	if tok, _, _ := p.scanIgnoreWhitespace(); tok == ORDER {
+		if stmt.SortFields, err = p.parseSortFields(stmt.Indices); err != nil {
+			return nil, err
+		}
+	} else {
+		p.unscan()
+	}
+	if tok, _, _ := p.scanIgnoreWhitespace(); tok == LIMIT {
+		if stmt.Limit, err = p.parseInt(1); err != nil {
+			return nil, err
+		}
+	} else {
+		p.unscan()
+	}
+	if tok, _, _ := p.scanIgnoreWhitespace(); tok == OFFSET {
+		if stmt.Offset, err = p.parseInt(0); err != nil {
+			return nil, err
+		}
+	} else {
+		p.unscan()
+	}
+	return stmt, nil
+}
 
-			for {
-				var indexName = ""
-				var tpe string
-				tok, lit := p.scanIgnoreWhitespace()
-				// fmt.Println("=> index begin ", tok, lit)
-				if tok != IDENT && tok != ParRight && tok != MIDEND {
-					p.unscan()
-					return nil, fmt.Errorf("found %q expected Index name or )", lit)
-				}
-				indexName += lit
-				tok, lit = p.scanIgnoreWhitespace()
-				// fmt.Println("=> index e", tok, lit)
-				if tok != OWN && tok != MIDEND {
-					p.unscan()
-					return nil, fmt.Errorf("found %q expected - or '", lit)
-				}
-				if tok == MIDEND {
-					indexName += "-"
-				}
-				// fmt.Println("=> mid ", tok, lit)
-				switch tok {
-				case MIDEND:
-					{
-						for {
-							tok, lit = p.scanIgnoreWhitespace()
-							// fmt.Println("=> mid and integer ", tok, lit)
-							if tok != IDENT && tok != MIDEND {
-								p.unscan()
-								// return nil, fmt.Errorf("found %q expect indexname", lit)
-								break
-							}
-							if tok == MIDEND {
-								indexName += "-"
-							}
-							if tok == IDENT {
-								indexName += lit
-							}
-							indexName += lit
-							// fmt.Println("-->", indexName)
-						}
-						tok, lit = p.scanIgnoreWhitespace()
-						if tok != OWN {
-							p.unscan()
-							return nil, fmt.Errorf("found %q expect end symbol '", lit)
-						}
-						goto TYPE
-
-					}
-				case OWN:
-					goto TYPE
-				}
-			TYPE:
-				{
-					tok, lit = p.scanIgnoreWhitespace()
-					if tok != IDENT {
-						p.unscan()
-						return nil, fmt.Errorf("found %q expecter type name", lit)
-					}
-					tpe = lit
-					// fmt.Println("--> typename", tpe)
-					indesToType[indexName] = tpe
-					tok, _ = p.scanIgnoreWhitespace()
-					if tok != COMMA && tok != ParRight {
-						p.unscan()
-						return nil, fmt.Errorf("found %q expecter , or )", lit)
-					}
-					if tok == ParRight {
-						stmt.IndexToTypeSet = append(stmt.IndexToTypeSet, indesToType)
-						break
-					}
-				}
+// parseInt parses an integer no smaller than min.
+func (p *Parser) parseInt(min int) (int, error) {
+	tok, pos, lit := p.scanIgnoreWhitespace()
+	if tok != INTEGER {
+		p.unscan()
+		return 0, newParseError(lit, []string{"integer"}, pos)
+	}
+	n, err := strconv.Atoi(lit)
+	if err != nil || n < min {
+		return 0, &ParseError{Message: fmt.Sprintf("integer %s out of range", lit), Found: lit, Expected: []string{"integer"}, Pos: pos}
+	}
+	return n, nil
+}
 
-			}
+// parseInterval parses a histogram interval such as `5m` or `1d`.
+func (p *Parser) parseInterval() (string, error) {
+	tok, pos, lit := p.scanIgnoreWhitespace()
+	if tok != INTEGER {
+		p.unscan()
+		return "", newParseError(lit, []string{"interval"}, pos)
+	}
+	n := lit
+	tok, _, unit := p.scan()
+	if tok != IDENT {
+		p.unscan()
+		return "", newParseError(n+unit, []string{"interval"}, pos)
+	}
+	switch unit {
+	case "ms", "s", "m", "h", "d", "w", "M", "q", "y":
+	default:
+		return "", &ParseError{Message: fmt.Sprintf("invalid interval %q", n+unit), Found: n + unit, Expected: []string{"interval"}, Pos: pos}
+	}
+	v, err := strconv.Atoi(n)
+	if err != nil || v <= 0 {
+		return "", &ParseError{Message: fmt.Sprintf("invalid interval %q", n+unit), Found: n + unit, Expected: []string{"interval"}, Pos: pos}
+	}
+	// Months, quarters and years vary in length and only exist as single
+	// calendar units.
+	if v > 1 && (unit == "M" || unit == "q" || unit == "y") {
+		return "", &ParseError{Message: fmt.Sprintf("invalid interval %q, expected 1%s", n+unit, unit), Found: n + unit, Expected: []string{"interval"}, Pos: pos}
+	}
+	return n + unit, nil
+}
 
-			//***********************
-			//CONDITION//
-			//**********************
-			//`LOOK (index1'tpe, index2'tpe): CONDITION [index1.field1 GT 100, index1.field2 PF "prefix", 2.field3 SF "suffix"}  AT {1.begin TO 1.end, 2.being TO 2.end]`
-			IndexToFieldMap := make(map[string]*Operation)
-
-			toc, lit := p.scanIgnoreWhitespace()
-			// fmt.Println("=> after", toc, lit)
-			if toc != IS {
-				p.unscan()
-				return nil, fmt.Errorf("found %q expecter : ", lit)
-			}
+// parseGroupBy parses a `GROUP BY [index.field, ...]` clause.
+// This function assumes the GROUP token has already been consumed.
+func (p *Parser) parseGroupBy(indices []*IndexRef) ([]*FieldRef, error) {
+	if err := p.expect(BY); err != nil {
+		return nil, err
+	}
+	if err := p.expect(MParLeft); err != nil {
+		return nil, err
+	}
 
-			toc, lit = p.scanIgnoreWhitespace()
-			// fmt.Println("=> key word ", toc, lit)
-			if toc != CONDITION {
-				p.unscan()
-				return nil, fmt.Errorf("found %q expecter CONDITION", lit)
-			}
+	var refs []*FieldRef
+	for {
+		ref := &FieldRef{}
+		var err error
+		if ref.Index, ref.Field, ref.Pos, err = p.parseFieldRef(indices); err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
 
-			toc, lit = p.scanIgnoreWhitespace()
-			// fmt.Println("=> con [ ", toc, lit)
-			if toc != MParLeft {
-				p.unscan()
-				return nil, fmt.Errorf("found %q expecter [", lit)
-			}
+		tok, pos, lit := p.scanIgnoreWhitespace()
+		if tok == MParRight {
+			return refs, nil
+		} else if tok != COMMA {
+			p.unscan()
+			return nil, newParseError(lit, []string{",", "]"}, pos)
+		}
+	}
+}
 
-			for {
-				var conditionIndexName string
-
-				O := new(Operation)
-				toc, lit = p.scanIgnoreWhitespace()
-				// fmt.Println("=> con index", toc, lit)
-				conditionIndexName += lit
-				// fmt.Println("con index name: ", conditionIndexName)
-				if toc != IDENT && toc != MParRight {
-					p.unscan()
-					return nil, fmt.Errorf("found %q expecter ]", lit)
-				}
-
-				toc, lit = p.scanIgnoreWhitespace()
-				// fmt.Println("=> field sep", toc, lit)
-				if toc != MIDEND && toc != OWN {
-					p.unscan()
-					return nil, fmt.Errorf("found %q expect type declare - or Point", lit)
-				}
-				switch toc {
-				case MIDEND:
-					{
-						conditionIndexName += "-"
-						for {
-							toc, lit = p.scanIgnoreWhitespace()
-							// fmt.Println("=> -field ", toc, lit)
-							if toc != MIDEND && toc != IDENT {
-								p.unscan()
-								// return nil, fmt.Errorf("found %q expect field name", lit)
-								break
-							}
-							if toc == MIDEND {
-								conditionIndexName += "-"
-							}
-							if toc == IDENT {
-								conditionIndexName += lit
-							}
-							// fmt.Println("=> filed re ", toc, lit)
-						}
-						toc, lit = p.scanIgnoreWhitespace()
-						if toc != OWN {
-							p.unscan()
-							return nil, fmt.Errorf("found %q expect end symbol", lit)
-						}
-						goto FIELD
-					}
-				case OWN:
-					goto FIELD
-				}
-
-				//*
-			FIELD:
-				{
-					// fmt.Println("--> cond index: ", conditionIndexName)
-					//*
-					/*
-						toc, lit = p.scan()
-						if toc != Point {
-							p.unscan()
-							return nil, fmt.Errorf("found %q expecter", lit)
-						}
-					*/
-					toc, lit = p.scan()
-					if toc != IDENT {
-						p.unscan()
-						return nil, fmt.Errorf("found %q expecter", lit)
-					}
-					//*
-					O.FieldName = lit
-					//*
-					toc, lit = p.scanIgnoreWhitespace()
-					if toc != EQ && toc != NEQ && toc != PF && toc != SF && toc != LT && toc != GT && toc != GTE && toc != LTE {
-						p.unscan()
-						return nil, fmt.Errorf("found %q expecter Opt: GT or LT or PF ...", lit)
-					}
-					I2O := make(map[string]*Operation)
-					I2OSet := make([]map[string]*Operation, 0)
-					// fmt.Println("=> case:", toc, lit)
-					switch toc {
-					case GT:
-						{
-							//*
-							O.Opt = "GT"
-							//*
-							gtTocNext, gtLitNext := p.scanIgnoreWhitespace()
-							// fmt.Println("=> gt int value", gtTocNext, gtLitNext)
-							if gtTocNext != IDENT {
-								p.unscan()
-								return nil, fmt.Errorf("found %q expecter int value", gtLitNext)
-							}
-							gtLitNextFloat, err := strconv.ParseFloat(gtLitNext, 64)
-							if err != nil {
-								panic(err)
-							}
-							//*
-							O.Value = gtLitNextFloat
-							O.ValueType = "Float64"
-							//*
-							I2O[conditionIndexName] = O
-							I2OSet = append(I2OSet, I2O)
-						}
-					case GTE:
-						{
-							//*
-							O.Opt = "GTE"
-							//*
-							gteTocNext, gteLitNext := p.scanIgnoreWhitespace()
-							// fmt.Println("=> gte int value", gteTocNext, gteLitNext)
-							if gteTocNext != IDENT {
-								p.unscan()
-								return nil, fmt.Errorf("found %q expecter int value", gteLitNext)
-							}
-							gteLitNextFloat, err := strconv.ParseFloat(gteLitNext, 64)
-							if err != nil {
-								panic(err)
-							}
-							//*
-							O.Value = gteLitNextFloat
-							O.ValueType = "Float64"
-							//*
-							I2O[conditionIndexName] = O
-							I2OSet = append(I2OSet, I2O)
-						}
-
-					case LT:
-						{
-							//*
-							O.Opt = "LT"
-							//*
-							ltTocNext, ltLitNext := p.scanIgnoreWhitespace()
-							// fmt.Println("=> lt int value", ltTocNext, ltLitNext)
-							if ltTocNext != IDENT {
-								p.unscan()
-								return nil, fmt.Errorf("found %q expecter int value", ltLitNext)
-							}
-							ltLitNextFloat, err := strconv.ParseFloat(ltLitNext, 64)
-							if err != nil {
-								panic(err)
-							}
-							O.Value = ltLitNextFloat
-							O.ValueType = "Float64"
-							I2O[conditionIndexName] = O
-							I2OSet = append(I2OSet, I2O)
-						}
-					case LTE:
-						{
-							//*
-							O.Opt = "LTE"
-							//*
-							lteTocNext, lteLitNext := p.scanIgnoreWhitespace()
-							// fmt.Println("=> lt int value", lteTocNext, lteLitNext)
-							if lteTocNext != IDENT {
-								p.unscan()
-								return nil, fmt.Errorf("found %q expecter int value", lteLitNext)
-							}
-							lteLitNextFloat, err := strconv.ParseFloat(lteLitNext, 64)
-							if err != nil {
-								panic(err)
-							}
-							O.Value = lteLitNextFloat
-							O.ValueType = "Float64"
-							I2O[conditionIndexName] = O
-							I2OSet = append(I2OSet, I2O)
-						}
-
-					case PF:
-						{
-							//*
-							O.Opt = "PF"
-							//*
-							pfTocNext, pfLitNext := p.scanIgnoreWhitespace()
-							// fmt.Println("=> pf string value begin", pfTocNext, pfLitNext)
-							if pfTocNext != STR {
-								p.unscan()
-								return nil, fmt.Errorf("found %q expecter string value prefix", pfLitNext)
-							}
-							pfTocNextT, pfLitNextL := p.scan()
-							// fmt.Println("=> pf string value", pfTocNextT, pfLitNextL)
-							if pfTocNextT != IDENT {
-								p.unscan()
-								return nil, fmt.Errorf("found %q expecter string value ", pfLitNextL)
-							}
-							pfTocEnd, pfLitEnd := p.scanIgnoreWhitespace()
-							// fmt.Println("=> pf string value end", pfTocEnd, pfLitEnd)
-							if pfTocEnd != STR {
-								p.unscan()
-								return nil, fmt.Errorf("found %q expecter string value end", pfLitEnd)
-							}
-							O.Value = pfLitNextL
-							O.ValueType = "string"
-							I2O[conditionIndexName] = O
-							I2OSet = append(I2OSet, I2O)
-						}
-					case SF:
-						{
-							//*
-							O.Opt = "SF"
-							//*
-							sfTocNext, sfLitNext := p.scanIgnoreWhitespace()
-							// fmt.Println("=> sf string value begin", sfTocNext, sfLitNext)
-							if sfTocNext != STR {
-								p.unscan()
-								return nil, fmt.Errorf("found %q expecter string value prefix", sfLitNext)
-							}
-							sfTocNextT, sfLitNextT := p.scan()
-							// fmt.Println("=> sf string value", sfTocNextT, sfLitNextT)
-							if sfTocNextT != IDENT {
-								p.unscan()
-								return nil, fmt.Errorf("found %q expecter string value", sfLitNextT)
-							}
-							sfTocEnd, sfLitEnd := p.scanIgnoreWhitespace()
-							// fmt.Println("=> sf string value end", sfTocEnd, sfLitEnd)
-							if sfTocEnd != STR {
-								p.unscan()
-								return nil, fmt.Errorf("found %q expecter string value end", sfLitEnd)
-							}
-							O.Value = sfLitNextT
-							O.ValueType = "string"
-							I2O[conditionIndexName] = O
-							I2OSet = append(I2OSet, I2O)
-
-						}
-					case EQ:
-						{
-							//*
-							O.Opt = "EQ"
-							//*
-							eqTocNext, eqLitNext := p.scanIgnoreWhitespace()
-							if eqTocNext != STR && eqTocNext != IDENT {
-								return nil, fmt.Errorf("found %q expect eq value", eqLitNext)
-							}
-							// fmt.Println("=> case eq", eqTocNext, eqLitNext)
-							switch eqTocNext {
-							case STR:
-								{
-									eqStrTocNext, eqStrLitNext := p.scan()
-									// fmt.Println("=> eq string value", eqStrTocNext, eqStrLitNext)
-									if eqStrTocNext != IDENT {
-										p.unscan()
-										return nil, fmt.Errorf("found %q expect: string value", eqStrLitNext)
-									}
-									eqStrTocNextL, eqStrLitNextL := p.scanIgnoreWhitespace()
-									// fmt.Println("=> eq string value end", eqStrTocNextL, eqStrLitNextL)
-									if eqStrTocNextL != STR {
-										return nil, fmt.Errorf("found %q expect: string value end", eqStrLitNextL)
-									}
-									O.Value = eqStrLitNext
-									O.ValueType = "string"
-									I2O[conditionIndexName] = O
-									I2OSet = append(I2OSet, I2O)
-
-								}
-							case IDENT:
-								{
-									floatValue, err := strconv.ParseFloat(eqLitNext, 64)
-									if err != nil {
-										panic(err)
-									}
-									O.Value = floatValue
-									O.ValueType = "Float64"
-									I2O[conditionIndexName] = O
-									I2OSet = append(I2OSet, I2O)
-								}
-
-							}
-
-						}
-					case NEQ:
-						{
-							//*
-							O.Opt = "NEQ"
-							//*
-							neqTocNext, neqLitNext := p.scanIgnoreWhitespace()
-							if neqTocNext != STR && neqTocNext != IDENT {
-								return nil, fmt.Errorf("found %q expect neq value.", neqLitNext)
-							}
-							// fmt.Println("=> neq case", neqTocNext, neqLitNext)
-							switch neqTocNext {
-							case STR:
-								{
-									neqTocNextL, neqLitNextL := p.scan()
-									// fmt.Println("=> neq string value", neqLitNextL)
-									if neqTocNextL != IDENT {
-										return nil, fmt.Errorf("found %q expect neq string value", neqLitNextL)
-									}
-									neqTocNextEnd, neqLitNextEnd := p.scanIgnoreWhitespace()
-									// fmt.Println("=> neq sting value end", neqTocNextEnd, neqLitNextEnd)
-									if neqTocNextEnd != STR {
-										return nil, fmt.Errorf("found %q expect neq string value end", neqLitNextEnd)
-									}
-									O.Value = neqLitNextL
-									O.ValueType = "string"
-									I2O[conditionIndexName] = O
-									I2OSet = append(I2OSet, I2O)
-								}
-							case IDENT:
-								{
-									valueFloat, err := strconv.ParseFloat(neqLitNext, 64)
-									if err != nil {
-										return nil, fmt.Errorf("found %q expect value: type int", neqLitNext)
-									}
-									O.Value = valueFloat
-									O.ValueType = "Float64"
-									I2O[conditionIndexName] = O
-									I2OSet = append(I2OSet, I2O)
-								}
-							}
-						}
-					}
-
-					stmt.IndexToFieldSet = append(stmt.IndexToFieldSet, I2OSet...)
-					toc, lit = p.scanIgnoreWhitespace()
-					if toc != COMMA && toc != MParRight {
-						p.unscan()
-						return nil, fmt.Errorf("fount %q expecter", lit)
-					}
-					if toc == MParRight {
-						stmt.IndexToFieldSet = append(stmt.IndexToFieldSet, IndexToFieldMap)
-						// return stmt, nil
-						break
-					}
-				}
-			}
-			atToken, atLit := p.scanIgnoreWhitespace()
-			// fmt.Println("=> AT | ", atToken, atLit)
-			if atToken != AT {
-				p.unscan()
-				return nil, fmt.Errorf("found %q expect AT", atLit)
-			}
-			atParLeftToken, atParLeftLit := p.scanIgnoreWhitespace()
-			// fmt.Println("=> AT par | ", atParLeftToken, atParLeftLit)
-			if atParLeftToken != MParLeft {
-				p.unscan()
-				return nil, fmt.Errorf("found %q expect [", atParLeftLit)
-			}
+// parseSortFields parses the list of an ORDER clause such as
+// `[web.ts DESC NULLS LAST, _score]`.
+// This function assumes the ORDER token has already been consumed.
+func (p *Parser) parseSortFields(indices []*IndexRef) ([]*SortField, error) {
+	if err := p.expect(MParLeft); err != nil {
+		return nil, err
+	}
 
-			//*
-			timeBeginStr := ""
-			timeEndStr := ""
-			//*
-			timeTok, timeLit := p.scanIgnoreWhitespace()
-			// fmt.Println("=> time value", timeTok, timeLit)
-			if timeTok != IDENT {
-				p.unscan()
-				return nil, fmt.Errorf("found %q expect time value", timeLit)
-			}
-			//*
-			timeBeginStr += timeLit
-			//*
-			timeTok, timeLit = p.scanIgnoreWhitespace()
-			// fmt.Println("=> time sep", timeTok, timeLit)
-			if timeTok != IS {
-				p.unscan()
-				return nil, fmt.Errorf("found %q expect .", timeLit)
+	var fields []*SortField
+	for {
+		f := &SortField{}
+		var err error
+		if f.Index, f.Field, f.Pos, err = p.parseFieldRef(indices); err != nil {
+			return nil, err
+		}
+		if err := p.parseSortOrder(f); err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+
+		tok, pos, lit := p.scanIgnoreWhitespace()
+		if tok == MParRight {
+			return fields, nil
+		} else if tok != COMMA {
+			p.unscan()
+			return nil, newParseError(lit, []string{",", "]", "ASC", "DESC", "NULLS"}, pos)
+		}
+	}
+}
+
+// parseSortOrder parses the optional ASC or DESC and `NULLS FIRST|LAST`
+// after a sort key. _score sorts descending by default.
+func (p *Parser) parseSortOrder(f *SortField) error {
+	f.Desc = f.Field == "_score"
+	switch tok, _, _ := p.scanIgnoreWhitespace(); tok {
+	case ASC:
+		f.Desc = false
+	case DESC:
+		f.Desc = true
+	default:
+		p.unscan()
+	}
+
+	if tok, _, _ := p.scanIgnoreWhitespace(); tok != NULLS {
+		p.unscan()
+		return nil
+	}
+	tok, pos, lit := p.scanIgnoreWhitespace()
+	if tok != IDENT || (strings.ToUpper(lit) != "FIRST" && strings.ToUpper(lit) != "LAST") {
+		p.unscan()
+		return newParseError(lit, []string{"FIRST", "LAST"}, pos)
+	}
+	if f.Field == "_score" {
+		return &ParseError{Message: "NULLS is not allowed on _score", Found: lit, Pos: pos}
+	}
+	f.Nulls = strings.ToUpper(lit)
+	return nil
+}
+
+// parseFieldRef parses an optionally index-qualified field such as `ts`,
+// `web.ts`, `1.ts` or `logs-2018'ts`. The first segment of a dotted name
+// is the index only when it refers to one of indices or cannot start a
+// field; otherwise the whole name is the field, as in `http.status`.
+func (p *Parser) parseFieldRef(indices []*IndexRef) (index, field string, pos Pos, err error) {
+	tok, pos, lit := p.scanIgnoreWhitespace()
+	if !isNameToken(tok) {
+		p.unscan()
+		return "", "", pos, newParseError(lit, []string{"field name"}, pos)
+	}
+	name := lit
+	for {
+		tok, _, lit := p.scan()
+		if isNameToken(tok) {
+			name += lit
+		} else if tok == MIDEND {
+			name += "-"
+		} else {
+			p.unscan()
+			break
+		}
+	}
+
+	tok, _, _ = p.scan()
+	if tok != Point && tok != OWN {
+		p.unscan()
+		return "", name, pos, nil
+	}
+	if field, err = p.parseFieldPath(); err != nil {
+		return "", "", pos, err
+	}
+	if tok == Point && !refersToIndex(indices, name) && parsesAs(name, (*Parser).parseFieldPath) {
+		return "", name + "." + field, pos, nil
+	}
+	return name, field, pos, nil
+}
+
+// parseFields parses a projection list such as
+// `[host, msg, -payload*, DOCVALUE(ts), SUM(web.bytes)]`. Metric function
+// calls are returned separately from the fields.
+func (p *Parser) parseFields(indices []*IndexRef) ([]*Field, []*Metric, error) {
+	if err := p.expect(MParLeft); err != nil {
+		return nil, nil, err
+	}
+
+	var fields []*Field
+	var metrics []*Metric
+	for {
+		f, m, err := p.parseProjectionItem(indices)
+		if err != nil {
+			return nil, nil, err
+		}
+		if m != nil {
+			metrics = append(metrics, m)
+		} else {
+			fields = append(fields, f)
+		}
+
+		tok, pos, lit := p.scanIgnoreWhitespace()
+		if tok == MParRight {
+			return fields, metrics, nil
+		} else if tok != COMMA {
+			p.unscan()
+			return nil, nil, newParseError(lit, []string{",", "]"}, pos)
+		}
+	}
+}
+
+// parseProjectionItem parses a single item of the projection list, which
+// is either a field or a metric function call.
+func (p *Parser) parseProjectionItem(indices []*IndexRef) (*Field, *Metric, error) {
+	f := &Field{}
+	tok, _, lit := p.scanIgnoreWhitespace()
+	switch tok {
+	case MIDEND:
+		f.Exclude = true
+	case DOCVALUE:
+		f.DocValue = true
+		if err := p.expect(ParLeft); err != nil {
+			return nil, nil, err
+		}
+	case IDENT:
+		// A metric function is a name directly followed by "(".
+		if fn := strings.ToUpper(lit); isMetricFunc(fn) {
+			if tok, _, _ := p.scan(); tok == ParLeft {
+				m, err := p.parseMetric(fn, indices)
+				return nil, m, err
 			}
-			//*
-			timeBeginStr += ":"
-			//*
-			timeTok, timeLit = p.scanIgnoreWhitespace()
-			// fmt.Println("=> time value", timeTok, timeLit)
-			//*
-			timeBeginStr += timeLit
-			stmt.TimeBegin = timeBeginStr
-			//*
-			timeTok, timeLit = p.scanIgnoreWhitespace()
-			// fmt.Println("=> mid", timeTok, timeLit)
-			if timeTok != MIDEND {
-				p.unscan()
-				return nil, fmt.Errorf("found %q expect - ", timeLit)
+			p.unscan()
+		}
+		f.Pattern = p.parseFieldPatternRest(lit)
+		return f, nil, nil
+	default:
+		p.unscan()
+	}
+
+	var err error
+	if f.Pattern, err = p.parseFieldPattern(); err != nil {
+		return nil, nil, err
+	}
+	if f.DocValue {
+		if err := p.expect(ParRight); err != nil {
+			return nil, nil, err
+		}
+	}
+	return f, nil, nil
+}
+
+// parseMetric parses the argument of a metric function call.
+// This function assumes the name and "(" have already been consumed.
+func (p *Parser) parseMetric(fn string, indices []*IndexRef) (*Metric, error) {
+	m := &Metric{Func: fn}
+	if tok, pos, lit := p.scanIgnoreWhitespace(); tok == ASTERISK {
+		if fn != "COUNT" {
+			return nil, &ParseError{Message: fmt.Sprintf("%s(*) is not supported", fn), Found: lit, Expected: []string{"field name"}, Pos: pos}
+		}
+		m.Field = "*"
+	} else {
+		p.unscan()
+		var err error
+		if m.Index, m.Field, m.Pos, err = p.parseFieldRef(indices); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect(ParRight); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// parseFieldPattern parses a field name that may contain "*" wildcards,
+// such as `user.*` or `payload*`. A projection item is always a field, so
+// the pattern may start with a keyword, as in `from`.
+func (p *Parser) parseFieldPattern() (string, error) {
+	tok, pos, lit := p.scanIgnoreWhitespace()
+	if tok != IDENT && tok != ASTERISK && !isKeyword(tok) {
+		p.unscan()
+		return "", newParseError(lit, []string{"field name"}, pos)
+	}
+	return p.parseFieldPatternRest(lit), nil
+}
+
+// parseFieldPatternRest parses the rest of a field pattern whose first
+// token has already been consumed.
+func (p *Parser) parseFieldPatternRest(pattern string) string {
+	for {
+		tok, _, lit := p.scan()
+		if isKeyword(tok) && strings.HasSuffix(pattern, ".") {
+			pattern += lit
+			continue
+		}
+		if !isNameToken(tok) && tok != Point && tok != ASTERISK {
+			p.unscan()
+			return pattern
+		}
+		pattern += lit
+	}
+}
+
+// parseCountStatement parses a TOTAL statement.
+// This function assumes the TOTAL token has already been consumed.
+func (p *Parser) parseCountStatement() (*CountStatement, error) {
+	stmt := &CountStatement{}
+	var err error
+	if stmt.Indices, err = p.parseIndexList(); err != nil {
+		return nil, err
+	}
+	if stmt.Where, err = p.parseCondition(); err != nil {
+		return nil, err
+	}
+	if stmt.Time, err = p.parseTimeRange(); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// parseRecentStatement parses a RECENT statement.
+// This function assumes the RECENT token has already been consumed.
+func (p *Parser) parseRecentStatement() (*RecentStatement, error) {
+	stmt := &RecentStatement{}
+	var err error
+	if stmt.Indices, err = p.parseIndexList(); err != nil {
+		return nil, err
+	}
+	if stmt.Size, err = p.parseTotal(); err != nil {
+		return nil, err
+	}
+	if stmt.Time, err = p.parseTimeRange(); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// parseTotal parses a `TOTAL [n]` clause.
+func (p *Parser) parseTotal() (int, error) {
+	if err := p.expect(TOTAL); err != nil {
+		return 0, err
+	}
+	if err := p.expect(MParLeft); err != nil {
+		return 0, err
+	}
+	n, err := p.parseInt(1)
+	if err != nil {
+		return 0, err
+	}
+	if err := p.expect(MParRight); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// parseIndexList parses a parenthesized list of indices with an optional
+// type, such as `(web'doc, app)`, followed by ":".
+func (p *Parser) parseIndexList() ([]*IndexRef, error) {
+	var refs []*IndexRef
+
+	if err := p.expect(ParLeft); err != nil {
+		return nil, err
+	}
+
+	for {
+		tok, pos, lit := p.scanIgnoreWhitespace()
+		if !isNameToken(tok) {
+			p.unscan()
+			return nil, newParseError(lit, []string{"index name"}, pos)
+		}
+		p.unscan()
+		ref, err := p.parseIndexRef(COMMA, ParRight)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+
+		tok, pos, lit = p.scanIgnoreWhitespace()
+		if tok != COMMA && tok != ParRight {
+			p.unscan()
+			return nil, newParseError(lit, []string{",", ")"}, pos)
+		}
+		if tok == ParRight {
+			break
+		}
+	}
+
+	if err := p.expect(IS); err != nil {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// parseIndexRef parses an `index'type` pair. The type is optional, in
+// which case the index name must be followed by one of seps, which is
+// left unread. An index name may not be all digits, since a number in a
+// qualifier is the position of an index.
+func (p *Parser) parseIndexRef(seps ...Token) (*IndexRef, error) {
+	_, pos, _ := p.scanIgnoreWhitespace()
+	p.unscan()
+	ref := &IndexRef{}
+	var err error
+	if ref.Name, err = p.parseIndexName(append([]Token{OWN}, seps...)...); err != nil {
+		return nil, err
+	}
+	if isDigits(ref.Name) {
+		return nil, &ParseError{Message: fmt.Sprintf("index name %s is a number, which qualifiers read as a position", ref.Name), Found: ref.Name, Expected: []string{"index name"}, Pos: pos}
+	}
+	// Put back the separator unless it introduces the type.
+	p.unscan()
+	if tok, _, _ := p.scan(); tok != OWN {
+		p.unscan()
+		return ref, nil
+	}
+
+	tok, pos, lit := p.scanIgnoreWhitespace()
+	if tok != IDENT {
+		p.unscan()
+		return nil, newParseError(lit, []string{"type name"}, pos)
+	}
+	ref.Type = lit
+	return ref, nil
+}
+
+// parseIndexName parses an index name such as `logs-2018-08` up to and
+// including one of the given separator tokens. The name may not contain
+// whitespace.
+func (p *Parser) parseIndexName(seps ...Token) (string, error) {
+	var name string
+	for {
+		tok, pos, lit := p.scan()
+		if tok == WS {
+			if name == "" {
+				continue
 			}
-			timeTok, timeLit = p.scanIgnoreWhitespace()
-			// fmt.Println("=> time value ", timeLit)
-			if timeTok != IDENT {
-				p.unscan()
-				return nil, fmt.Errorf("found %q expect time value", timeLit)
+			// Whitespace ends the name; only a separator may follow.
+			tok, pos, lit = p.scanIgnoreWhitespace()
+			if tok == IDENT || tok == INTEGER || tok == NUMBER || tok == MIDEND {
+				tok = ILLEGAL
 			}
-			//*
-			timeEndStr += timeLit
-			//*
-			timeTok, timeLit = p.scanIgnoreWhitespace()
-			if timeTok != IS {
-				p.unscan()
-				return nil, fmt.Errorf("found %q expect :", timeLit)
+		}
+		switch tok {
+		case IDENT, INTEGER, NUMBER:
+			name += lit
+			continue
+		case MIDEND:
+			name += "-"
+			continue
+		}
+		for _, sep := range seps {
+			if tok == sep && name != "" {
+				return name, nil
 			}
-			timeEndStr += ":"
-			timeTok, timeLit = p.scanIgnoreWhitespace()
-			// fmt.Println("=> time value", timeLit)
-			if timeTok != IDENT {
-				p.unscan()
-				return nil, fmt.Errorf("found %q expect time value", timeLit)
+		}
+		p.unscan()
+		expected := make([]string, len(seps))
+		for i, sep := range seps {
+			expected[i] = sep.String()
+		}
+		return "", newParseError(lit, expected, pos)
+	}
+}
+
+// parseCondition parses a `CONDITION [...]` clause. Comma separated items
+// are ANDed together; each item may combine conditions with AND, OR, NOT
+// and parentheses. An empty clause returns a nil expression.
+// `LOOK (index1'tpe, index2'tpe): CONDITION [index1.field1 GT 100 OR NOT index1.field2 PF "prefix", index2.field3 SF "suffix"] AT [...]`
+func (p *Parser) parseCondition() (Expr, error) {
+	if err := p.expect(CONDITION); err != nil {
+		return nil, err
+	}
+	if err := p.expect(MParLeft); err != nil {
+		return nil, err
+	}
+	if tok, _, _ := p.scanIgnoreWhitespace(); tok == MParRight {
+		return nil, nil
+	}
+	p.unscan()
+
+	var expr Expr
+	for {
+		item, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if expr == nil {
+			expr = item
+		} else {
+			expr = &BinaryExpr{Op: AND, LHS: expr, RHS: item}
+		}
+
+		tok, pos, lit := p.scanIgnoreWhitespace()
+		if tok == MParRight {
+			return expr, nil
+		} else if tok != COMMA {
+			p.unscan()
+			return nil, newParseError(lit, []string{",", "]", "AND", "OR"}, pos)
+		}
+	}
+}
+
+// parseExpr parses an OR expression.
+func (p *Parser) parseExpr() (Expr, error) {
+	expr, err := p.parseAndExpr()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if tok, _, _ := p.scanIgnoreWhitespace(); tok != OR {
+			p.unscan()
+			return expr, nil
+		}
+		rhs, err := p.parseAndExpr()
+		if err != nil {
+			return nil, err
+		}
+		expr = &BinaryExpr{Op: OR, LHS: expr, RHS: rhs}
+	}
+}
+
+// parseAndExpr parses an AND expression, which binds tighter than OR.
+func (p *Parser) parseAndExpr() (Expr, error) {
+	expr, err := p.parseUnaryExpr()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if tok, _, _ := p.scanIgnoreWhitespace(); tok != AND {
+			p.unscan()
+			return expr, nil
+		}
+		rhs, err := p.parseUnaryExpr()
+		if err != nil {
+			return nil, err
+		}
+		expr = &BinaryExpr{Op: AND, LHS: expr, RHS: rhs}
+	}
+}
+
+// parseUnaryExpr parses a NOT expression, a parenthesized expression or a
+// single condition.
+func (p *Parser) parseUnaryExpr() (Expr, error) {
+	tok, pos, lit := p.scanIgnoreWhitespace()
+	switch tok {
+	case NOT:
+		expr, err := p.parseUnaryExpr()
+		if err != nil {
+			return nil, err
+		}
+		return &NotExpr{Expr: expr}, nil
+	case ParLeft:
+		expr, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(ParRight); err != nil {
+			return nil, err
+		}
+		return &ParenExpr{Expr: expr}, nil
+	case IDENT, INTEGER, NUMBER, ASTERISK:
+		p.unscan()
+		return p.parseConditionItem()
+	}
+	p.unscan()
+	return nil, newParseError(lit, []string{"index name", "NOT", "("}, pos)
+}
+
+// parseConditionItem parses an `index.field OPT value` condition.
+// The index may also be separated from the field by "'". A `*.` in place
+// of the index applies the condition to every index.
+func (p *Parser) parseConditionItem() (*Condition, error) {
+	cond := &Condition{}
+	_, cond.Pos, _ = p.scanIgnoreWhitespace()
+	p.unscan()
+	var err error
+	if tok, _, _ := p.scanIgnoreWhitespace(); tok == ASTERISK {
+		if tok, pos, lit := p.scan(); tok != Point {
+			p.unscan()
+			return nil, newParseError(lit, []string{"."}, pos)
+		}
+	} else {
+		p.unscan()
+		if cond.Index, err = p.parseIndexName(Point, OWN); err != nil {
+			return nil, err
+		}
+	}
+	if cond.Field, err = p.parseFieldPath(); err != nil {
+		return nil, err
+	}
+
+	tok, pos, lit := p.scanIgnoreWhitespace()
+	cond.Op = tok
+	switch tok {
+	case GT, GTE, LT, LTE, EQ, NEQ, PF, SF:
+	default:
+		p.unscan()
+		return nil, newParseError(lit, []string{"GT", "GTE", "LT", "LTE", "EQ", "NEQ", "PF", "SF"}, pos)
+	}
+
+	_, valPos, _ := p.scanIgnoreWhitespace()
+	p.unscan()
+	if cond.Value, err = p.parseLiteral(); err != nil {
+		return nil, err
+	}
+	if err := checkOperand(tok, cond.Value, valPos); err != nil {
+		return nil, err
+	}
+	return cond, nil
+}
+
+// checkOperand returns an error if lit cannot be compared with op.
+func checkOperand(op Token, lit Literal, pos Pos) error {
+	switch op {
+	case GT, GTE, LT, LTE:
+		if !isNumeric(lit) {
+			if _, ok := lit.(*StringLiteral); !ok {
+				return &ParseError{Message: fmt.Sprintf("%s expects a number or string, found %s", op, lit), Found: lit.String(), Expected: []string{"number", "string"}, Pos: pos}
 			}
-			//*
-			timeEndStr += timeLit
-			stmt.TimeEnd = timeEndStr
-			//*
-			timeTok, timeLit = p.scanIgnoreWhitespace()
-			if timeTok != MParRight {
-				p.unscan()
-				return nil, fmt.Errorf("found %q expect ]", timeLit)
-			} else {
-				return stmt, nil
+		}
+	case PF, SF:
+		if _, ok := lit.(*StringLiteral); !ok {
+			return &ParseError{Message: fmt.Sprintf("%s expects a string, found %s", op, lit), Found: lit.String(), Expected: []string{"string"}, Pos: pos}
+		}
+	}
+	return nil
+}
+
+// parseLiteral parses a string, number, boolean or NULL literal. A "-"
+// directly followed by a number negates it.
+func (p *Parser) parseLiteral() (Literal, error) {
+	tok, pos, lit := p.scanIgnoreWhitespace()
+	switch tok {
+	case STRING, BADSTRING, BADESCAPE:
+		p.unscan()
+		s, err := p.parseString()
+		if err != nil {
+			return nil, err
+		}
+		return &StringLiteral{Val: s}, nil
+	case TRUE:
+		return &BooleanLiteral{Val: true}, nil
+	case FALSE:
+		return &BooleanLiteral{Val: false}, nil
+	case NULL:
+		return &NullLiteral{}, nil
+	case MIDEND:
+		if tok, _, _ := p.scan(); tok != INTEGER && tok != NUMBER {
+			p.unscan()
+			return nil, newParseError(lit, []string{"number"}, pos)
+		}
+		p.unscan()
+		return p.parseNumber("-", pos)
+	case INTEGER, NUMBER:
+		p.unscan()
+		return p.parseNumber("", pos)
+	}
+	p.unscan()
+	return nil, newParseError(lit, []string{"string", "number", "TRUE", "FALSE", "NULL"}, pos)
+}
+
+// parseNumber parses an integer or floating-point literal with the given
+// sign prefix. Integers that overflow int64 are reported as errors rather
+// than losing precision.
+func (p *Parser) parseNumber(sign string, pos Pos) (Literal, error) {
+	tok, _, lit := p.scan()
+	switch tok {
+	case INTEGER:
+		v, err := strconv.ParseInt(sign+lit, 10, 64)
+		if err != nil {
+			return nil, &ParseError{Message: fmt.Sprintf("integer %s%s out of range", sign, lit), Found: sign + lit, Expected: []string{"number"}, Pos: pos}
+		}
+		return &IntegerLiteral{Val: v}, nil
+	case NUMBER:
+		v, err := strconv.ParseFloat(sign+lit, 64)
+		if err != nil {
+			return nil, &ParseError{Message: fmt.Sprintf("invalid number %q", sign+lit), Found: sign + lit, Expected: []string{"number"}, Pos: pos}
+		}
+		return &NumberLiteral{Val: v}, nil
+	}
+	p.unscan()
+	return nil, newParseError(lit, []string{"number"}, pos)
+}
+
+// parseFieldPath parses a possibly dotted field name such as `http.status`.
+// A field path always follows a "." or "'", so its segments may be
+// keywords, as in `mail.from` or `order.group`.
+func (p *Parser) parseFieldPath() (string, error) {
+	tok, pos, lit := p.scan()
+	if tok != IDENT && !isKeyword(tok) {
+		p.unscan()
+		return "", newParseError(lit, []string{"field name"}, pos)
+	}
+	path := lit
+	for {
+		if tok, _, _ := p.scan(); tok != Point {
+			p.unscan()
+			return path, nil
+		}
+		tok, pos, lit := p.scan()
+		if tok != IDENT && !isKeyword(tok) {
+			p.unscan()
+			return "", newParseError(lit, []string{"field name"}, pos)
+		}
+		path += "." + lit
+	}
+}
+
+// parseString parses a quoted string literal.
+func (p *Parser) parseString() (string, error) {
+	tok, pos, lit := p.scanIgnoreWhitespace()
+	switch tok {
+	case STRING:
+		return lit, nil
+	case BADSTRING:
+		return "", &ParseError{Message: "unterminated string", Found: lit, Expected: []string{"string"}, Pos: pos}
+	case BADESCAPE:
+		return "", &ParseError{Message: fmt.Sprintf("bad escape %q", lit), Found: lit, Expected: []string{"string"}, Pos: pos}
+	}
+	p.unscan()
+	return "", newParseError(lit, []string{"string"}, pos)
+}
+
+// parseTimeRange parses an `AT [begin - end]` clause. Each bound is either
+// date math such as `now-15m` or must match one of the parser's
+// TimeLayouts, such as `YYYY.MM.DD:hh.mm.ss`. Either bound may be omitted
+// to leave that side of the window open, as in `[now-1h - ]`.
+func (p *Parser) parseTimeRange() (*TimeRange, error) {
+	if err := p.expect(AT); err != nil {
+		return nil, err
+	}
+	if err := p.expect(MParLeft); err != nil {
+		return nil, err
+	}
+
+	tr := &TimeRange{}
+	tok, pos, lit := p.scanIgnoreWhitespace()
+	p.unscan()
+	if tok != MIDEND {
+		b, err := p.parseTimeBound()
+		if err != nil {
+			return nil, err
+		}
+		tr.Begin = b
+	}
+	if err := p.expect(MIDEND); err != nil {
+		return nil, err
+	}
+	if tok, _, _ := p.scanIgnoreWhitespace(); tok != MParRight {
+		p.unscan()
+		b, err := p.parseTimeBound()
+		if err != nil {
+			return nil, err
+		}
+		tr.End = b
+		if err := p.expect(MParRight); err != nil {
+			return nil, err
+		}
+	}
+
+	if tr.Begin == nil && tr.End == nil {
+		return nil, newParseError(lit, []string{"time value"}, pos)
+	}
+	if tr.Begin != nil && tr.End != nil && !tr.Begin.IsMath() && !tr.End.IsMath() && tr.Begin.Time.After(tr.End.Time) {
+		return nil, &ParseError{Message: "time range begins after it ends", Pos: pos}
+	}
+	return tr, nil
+}
+
+// parseTimeBound parses a single time bound. A bound is made of adjacent
+// tokens, so `now-15m` and `2018-08-15` are one bound while ` - ` separates
+// two.
+func (p *Parser) parseTimeBound() (*TimeBound, error) {
+	tok, pos, lit := p.scanIgnoreWhitespace()
+	if !isNameToken(tok) {
+		p.unscan()
+		return nil, newParseError(lit, []string{"time value"}, pos)
+	}
+	text := lit
+	for {
+		tok, _, lit := p.scan()
+		if !isNameToken(tok) && tok != IS && tok != Point && tok != MIDEND && tok != PLUS && tok != SLASH {
+			p.unscan()
+			break
+		}
+		text += lit
+	}
+	return p.timeBound(text, pos)
+}
+
+// timeBound returns the time bound written as text, which is either date
+// math or a time in one of the parser's TimeLayouts.
+func (p *Parser) timeBound(text string, pos Pos) (*TimeBound, error) {
+	if strings.HasPrefix(text, "now") {
+		if _, err := EvalDateMath(text, time.Now(), false); err != nil {
+			return nil, &ParseError{Message: err.Error(), Found: text, Expected: []string{"time value"}, Pos: pos}
+		}
+		return &TimeBound{Math: text}, nil
+	}
+	for _, layout := range p.TimeLayouts {
+		if t, err := time.ParseInLocation(layout, text, time.UTC); err == nil {
+			// Bounds must have a four-digit year in UTC to be formatted.
+			if y := t.UTC().Year(); y < 0 || y > 9999 {
+				return nil, &ParseError{Message: fmt.Sprintf("time %q out of range", text), Found: text, Expected: []string{"time value"}, Pos: pos}
 			}
-			/*
-				// fmt.Println("TIME:", timeBeginStr)
-				//*
-				stmt.TimeBegin = timeBeginStr
-				//*
-				timeTokEnd, timeLitEnd := p.scanIgnoreWhitespace()
-				// fmt.Println("=> time end | ", timeTokEnd, timeLitEnd)
-				if timeTokEnd != WS {
-					p.unscan()
-					return nil, fmt.Errorf("found %q expect time", timeLitEnd)
-				}
-				//*
-				timeEndStr += timeLitEnd
-				stmt.TimeEnd = timeEndStr
-				//*
-				timeTok, timeLit = p.scanIgnoreWhitespace()
-				if timeTok != MParRight {
-					p.unscan()
-					return nil, fmt.Errorf("found %q expect ]", timeLit)
-				} else {
-					return stmt, nil
-				}
-			*/
+			return &TimeBound{Time: t}, nil
 		}
+	}
+	return nil, &ParseError{Message: fmt.Sprintf("invalid time %q", text), Found: text, Expected: []string{"time value"}, Pos: pos}
+}
 
+// isMetricFunc returns true if name is a metric function.
+func isMetricFunc(name string) bool {
+	switch name {
+	case "COUNT", "SUM", "AVG", "MIN", "MAX", "CARDINALITY":
+		return true
 	}
+	return false
+}
 
-	return stmt, nil
+// isNameToken returns true if tok can be part of an index name or a time
+// bound, which may mix identifiers and numbers.
+func isNameToken(tok Token) bool {
+	return tok == IDENT || tok == INTEGER || tok == NUMBER
+}
+
+// isKeyword returns true if tok is a keyword. After a "." in a field path
+// a keyword is only a name, as in `mail.from`.
+func isKeyword(tok Token) bool {
+	return tok > keywordBeg && tok < keywordEnd
+}
+
+// expect scans the next non-whitespace token and returns an error if it
+// is not tok.
+func (p *Parser) expect(tok Token) error {
+	t, pos, lit := p.scanIgnoreWhitespace()
+	if t != tok {
+		p.unscan()
+		return newParseError(lit, []string{tok.String()}, pos)
+	}
+	return nil
 }
 
 // scan returns the next token from the underlying scanner.
 // If a token has been unscanned then read that instead.
-func (p *Parser) scan() (tok Token, lit string) {
+func (p *Parser) scan() (tok Token, pos Pos, lit string) {
 	// If we have a token on the buffer, then return it.
 	if p.buf.n != 0 {
 		p.buf.n = 0
-		return p.buf.tok, p.buf.lit
+	} else {
+		// Otherwise read the next token from the scanner and save it to
+		// the buffer in case we unscan later.
+		tok, pos, lit = p.s.Scan()
+		p.buf.tok, p.buf.pos, p.buf.lit, p.buf.end = tok, pos, lit, p.s.pos
 	}
 
-	// Otherwise read the next token from the scanner.
-	tok, lit = p.s.Scan()
-
-	// Save it to the buffer in case we unscan later.
-	p.buf.tok, p.buf.lit = tok, lit
-
-	return
+	if p.buf.tok != WS && p.buf.tok != EOF {
+		p.prevEnd, p.end = p.end, p.buf.end
+	}
+	return p.buf.tok, p.buf.pos, p.buf.lit
 }
 
 // scanIgnoreWhitespace scans the next non-whitespace token.
-func (p *Parser) scanIgnoreWhitespace() (tok Token, lit string) {
-	tok, lit = p.scan()
+func (p *Parser) scanIgnoreWhitespace() (tok Token, pos Pos, lit string) {
+	tok, pos, lit = p.scan()
 	if tok == WS {
-		tok, lit = p.scan()
+		tok, pos, lit = p.scan()
 	}
 	return
 }
 
 // unscan pushes the previously read token back onto the buffer.
-func (p *Parser) unscan() { p.buf.n = 1 }
+func (p *Parser) unscan() {
+	p.buf.n = 1
+	if p.buf.tok != WS && p.buf.tok != EOF {
+		p.end = p.prevEnd
+	}
+}
@@ -5,23 +5,36 @@ import (
 	"bytes"
 	"io"
 	"regexp"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 //`LOOK (index1'tpe, index2'tpe): [field1, field2, field3]  CONDITION: {1.field1 GT 100, 1.field2 PF "prefix", 2.field3 SF "suffix"}  AT: {1.begin TO 1.end, 2.being TO 2.end}`.
 
 // Scanner represents a lexical scanner.
 type Scanner struct {
-	r *bufio.Reader
+	r    *bufio.Reader
+	pos  Pos   // position of the next rune
+	prev Pos   // position before the last read, restored by unread
+	last Token // last token returned
 }
 
 // NewScanner returns a new instance of Scanner.
 func NewScanner(r io.Reader) *Scanner {
-	return &Scanner{r: bufio.NewReader(r)}
+	return &Scanner{r: bufio.NewReader(r), pos: Pos{Line: 1, Column: 1}}
 }
 
-// Scan returns the next token and literal value.
-func (s *Scanner) Scan() (tok Token, lit string) {
+// Scan returns the next token, its starting position and literal value.
+func (s *Scanner) Scan() (tok Token, pos Pos, lit string) {
+	pos = s.pos
+	tok, lit = s.scan()
+	s.last = tok
+	return tok, pos, lit
+}
+
+// scan returns the next token and literal value.
+func (s *Scanner) scan() (tok Token, lit string) {
 	// Read the next rune.
 	ch := s.read()
 
@@ -31,12 +44,12 @@ func (s *Scanner) Scan() (tok Token, lit string) {
 	if isWhitespace(ch) {
 		s.unread()
 		return s.scanWhitespace()
-	} else if isLetter(ch) {
+	} else if isLetter(ch) || ch == '_' {
 		s.unread()
 		return s.scanIdent()
 	} else if isDigit(ch) {
 		s.unread()
-		return s.scanInteger()
+		return s.scanNumber()
 	}
 
 	// Otherwise read the individual character.
@@ -50,9 +63,16 @@ func (s *Scanner) Scan() (tok Token, lit string) {
 	case ',':
 		return COMMA, string(ch)
 	case '\'':
-		return OWN, string(ch)
+		// A quote directly after an identifier joins `index'type`;
+		// anywhere else it starts a string.
+		if isNameToken(s.last) {
+			return OWN, string(ch)
+		}
+		return s.scanString(ch)
 	case ':':
 		return IS, string(ch)
+	case ';':
+		return SEMICOLON, string(ch)
 	case '{':
 		return BParLeft, string(ch)
 	case '}':
@@ -64,11 +84,37 @@ func (s *Scanner) Scan() (tok Token, lit string) {
 	case '.':
 		return Point, string(ch)
 	case '"':
-		return STR, string(ch)
+		return s.scanString(ch)
 	case '-':
 		return MIDEND, string(ch)
 	case '>':
+		if s.read() == '=' {
+			return GTESIGN, ">="
+		}
+		s.unread()
 		return PointRight, string(ch)
+	case '<':
+		switch s.read() {
+		case '=':
+			return LTESIGN, "<="
+		case '>':
+			return NEQSIGN, "<>"
+		}
+		s.unread()
+		return LTSIGN, string(ch)
+	case '=':
+		return EQSIGN, string(ch)
+	case '!':
+		if s.read() == '=' {
+			return NEQSIGN, "!="
+		}
+		s.unread()
+	case '+':
+		return PLUS, string(ch)
+	case '/':
+		return SLASH, string(ch)
+	case '*':
+		return ASTERISK, string(ch)
 	}
 
 	return ILLEGAL, string(ch)
@@ -96,23 +142,121 @@ func (s *Scanner) scanWhitespace() (tok Token, lit string) {
 	return WS, buf.String()
 }
 
-func (s *Scanner) scanInteger() (tok Token, lit string) {
+// scanNumber consumes a number such as `100`, `1.5` or `2e-3`. Runs of
+// digits with several dots such as `2018.08.15` are returned as an IDENT.
+// A dot that is not followed by a digit is left for the next token.
+func (s *Scanner) scanNumber() (tok Token, lit string) {
 	var buf bytes.Buffer
 	buf.WriteRune(s.read())
 
+	dots := 0
 	for {
-		if ch := s.read(); ch == eof {
-			break
-			// return WS, buf.String()
-		} else if !isDigit(ch) && ch != '.' {
-			s.unread()
-			break
+		// Peek rather than read so a trailing dot is never consumed.
+		b, _ := s.r.Peek(2)
+		if len(b) > 0 && isDigit(rune(b[0])) {
+			buf.WriteRune(s.read())
+		} else if len(b) == 2 && b[0] == '.' && isDigit(rune(b[1])) {
+			buf.WriteRune(s.read())
+			dots++
 		} else {
-			// fmt.Println("=>", string(ch))
+			break
+		}
+	}
+	if dots > 1 {
+		return IDENT, buf.String()
+	}
+
+	// Read an optional exponent such as `e10` or `E-3`.
+	if b, _ := s.r.Peek(3); len(b) >= 2 && (b[0] == 'e' || b[0] == 'E') {
+		n := 1
+		if b[1] == '+' || b[1] == '-' {
+			n = 2
+		}
+		if len(b) > n && isDigit(rune(b[n])) {
+			for i := 0; i < n; i++ {
+				buf.WriteRune(s.read())
+			}
+			for {
+				if ch := s.read(); isDigit(ch) {
+					buf.WriteRune(ch)
+				} else {
+					if ch != eof {
+						s.unread()
+					}
+					break
+				}
+			}
+			return NUMBER, buf.String()
+		}
+	}
+
+	if dots == 1 {
+		return NUMBER, buf.String()
+	}
+	return INTEGER, buf.String()
+}
+
+// scanString consumes a string literal up to the closing quote and
+// returns its unescaped value. The opening quote has already been read.
+// Escapes follow Go syntax, plus \' and \/.
+func (s *Scanner) scanString(quote rune) (tok Token, lit string) {
+	var buf bytes.Buffer
+	for {
+		ch := s.read()
+		switch ch {
+		case quote:
+			return STRING, buf.String()
+		case eof, '\n':
+			return BADSTRING, buf.String()
+		case '\\':
+			ch = s.read()
+			switch ch {
+			case 'a':
+				buf.WriteRune('\a')
+			case 'b':
+				buf.WriteRune('\b')
+			case 'f':
+				buf.WriteRune('\f')
+			case 'n':
+				buf.WriteRune('\n')
+			case 'r':
+				buf.WriteRune('\r')
+			case 't':
+				buf.WriteRune('\t')
+			case 'v':
+				buf.WriteRune('\v')
+			case '\\', '"', '\'', '/':
+				buf.WriteRune(ch)
+			case 'x', 'u', 'U':
+				n := 2
+				if ch == 'u' {
+					n = 4
+				} else if ch == 'U' {
+					n = 8
+				}
+				hex := make([]rune, 0, n)
+				for i := 0; i < n; i++ {
+					h := s.read()
+					if !isHexDigit(h) {
+						return BADESCAPE, `\` + string(ch) + string(hex) + string(h)
+					}
+					hex = append(hex, h)
+				}
+				v, _ := strconv.ParseUint(string(hex), 16, 32)
+				if ch == 'x' {
+					buf.WriteByte(byte(v))
+				} else if !utf8.ValidRune(rune(v)) {
+					return BADESCAPE, `\` + string(ch) + string(hex)
+				} else {
+					buf.WriteRune(rune(v))
+				}
+			default:
+				return BADESCAPE, `\` + string(ch)
+			}
+		default:
 			buf.WriteRune(ch)
 		}
 	}
-	return IDENT, buf.String()
 }
 
 // scanIdent consumes the current rune and all contiguous ident runes.
@@ -138,8 +282,10 @@ func (s *Scanner) scanIdent() (tok Token, lit string) {
 	switch strings.ToUpper(buf.String()) {
 	case "LOOK":
 		return LOOK, buf.String()
-	case "TOTAl":
+	case "TOTAL":
 		return TOTAL, buf.String()
+	case "RECENT":
+		return RECENT, buf.String()
 	case "CONDITION":
 		return CONDITION, buf.String()
 	case "AT":
@@ -160,6 +306,50 @@ func (s *Scanner) scanIdent() (tok Token, lit string) {
 		return GTE, buf.String()
 	case "LTE":
 		return LTE, buf.String()
+	case "AND":
+		return AND, buf.String()
+	case "OR":
+		return OR, buf.String()
+	case "NOT":
+		return NOT, buf.String()
+	case "TRUE":
+		return TRUE, buf.String()
+	case "FALSE":
+		return FALSE, buf.String()
+	case "NULL":
+		return NULL, buf.String()
+	case "DOCVALUE":
+		return DOCVALUE, buf.String()
+	case "ORDER":
+		return ORDER, buf.String()
+	case "ASC":
+		return ASC, buf.String()
+	case "DESC":
+		return DESC, buf.String()
+	case "NULLS":
+		return NULLS, buf.String()
+	case "LIMIT":
+		return LIMIT, buf.String()
+	case "OFFSET":
+		return OFFSET, buf.String()
+	case "GROUP":
+		return GROUP, buf.String()
+	case "BY":
+		return BY, buf.String()
+	case "BUCKET":
+		return BUCKET, buf.String()
+	case "EVERY":
+		return EVERY, buf.String()
+	case "SELECT":
+		return SELECT, buf.String()
+	case "FROM":
+		return FROM, buf.String()
+	case "WHERE":
+		return WHERE, buf.String()
+	case "BETWEEN":
+		return BETWEEN, buf.String()
+	case "LIKE":
+		return LIKE, buf.String()
 	}
 
 	// Otherwise return as a regular identifier.
@@ -169,15 +359,27 @@ func (s *Scanner) scanIdent() (tok Token, lit string) {
 // read reads the next rune from the buffered reader.
 // Returns the rune(0) if an error occurs (or io.EOF is returned).
 func (s *Scanner) read() rune {
-	ch, _, err := s.r.ReadRune()
+	s.prev = s.pos
+	ch, size, err := s.r.ReadRune()
 	if err != nil {
 		return eof
 	}
+	s.pos.Offset += size
+	if ch == '\n' {
+		s.pos.Line++
+		s.pos.Column = 1
+	} else {
+		s.pos.Column++
+	}
 	return ch
 }
 
 // unread places the previously read rune back on the reader.
-func (s *Scanner) unread() { _ = s.r.UnreadRune() }
+func (s *Scanner) unread() {
+	if err := s.r.UnreadRune(); err == nil {
+		s.pos = s.prev
+	}
+}
 
 // isWhitespace returns true if the rune is a space, tab, or newline.
 func isWhitespace(ch rune) bool { return ch == ' ' || ch == '\t' || ch == '\n' }
@@ -185,6 +387,11 @@ func isWhitespace(ch rune) bool { return ch == ' ' || ch == '\t' || ch == '\n' }
 // isLetter returns true if the rune is a letter.
 func isLetter(ch rune) bool { return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') }
 
+// isHexDigit returns true if the rune is a hexadecimal digit.
+func isHexDigit(ch rune) bool {
+	return isDigit(ch) || (ch >= 'a' && ch <= 'f') || (ch >= 'A' && ch <= 'F')
+}
+
 // isDigit returns true if the rune is a digit.
 func isDigit(ch rune) bool { return (ch >= '0' && ch <= '9') }
 
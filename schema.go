@@ -0,0 +1,401 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// Schema holds the field types of index mappings loaded from `_mapping`
+// responses.
+type Schema struct {
+	// mappings maps an index to its mapping types and each type to its
+	// fields. Mappings without types are stored under "".
+	mappings map[string]map[string]map[string]string
+}
+
+// NewSchema returns a new, empty instance of Schema.
+func NewSchema() *Schema {
+	return &Schema{mappings: make(map[string]map[string]map[string]string)}
+}
+
+// LoadSchema returns a schema with the mappings of the given files.
+func LoadSchema(paths ...string) (*Schema, error) {
+	s := NewSchema()
+	for _, path := range paths {
+		if err := s.LoadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// LoadFile adds the mappings of a `_mapping` response saved to path.
+func (s *Schema) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := s.Load(f); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return nil
+}
+
+// Load adds the mappings of a `GET /index/_mapping` response. Both typed
+// mappings and the typeless mappings of Elasticsearch 7 are accepted.
+func (s *Schema) Load(r io.Reader) error {
+	var resp map[string]struct {
+		Mappings map[string]json.RawMessage `json:"mappings"`
+	}
+	if err := json.NewDecoder(r).Decode(&resp); err != nil {
+		return err
+	}
+
+	for index, m := range resp {
+		types := s.mappings[index]
+		if types == nil {
+			types = make(map[string]map[string]string)
+			s.mappings[index] = types
+		}
+
+		if props, ok := m.Mappings["properties"]; ok {
+			fields, err := mappingFields(props)
+			if err != nil {
+				return fmt.Errorf("mapping of %s: %s", index, err)
+			}
+			types[""] = fields
+			continue
+		}
+		for typ, raw := range m.Mappings {
+			if typ == "_default_" {
+				continue
+			}
+			var mapping struct {
+				Properties json.RawMessage `json:"properties"`
+			}
+			if err := json.Unmarshal(raw, &mapping); err != nil {
+				return fmt.Errorf("mapping of %s'%s: %s", index, typ, err)
+			}
+			fields, err := mappingFields(mapping.Properties)
+			if err != nil {
+				return fmt.Errorf("mapping of %s'%s: %s", index, typ, err)
+			}
+			types[typ] = fields
+		}
+	}
+	return nil
+}
+
+// fieldMapping represents a field in the `properties` of a mapping.
+type fieldMapping struct {
+	Type       string                  `json:"type"`
+	Path       string                  `json:"path"` // target of an alias
+	Properties json.RawMessage         `json:"properties"`
+	Fields     map[string]fieldMapping `json:"fields"` // multi-fields
+}
+
+// mappingFields returns the types of every field in properties by dotted
+// name. Objects are reported as "object" and multi-fields such as
+// `name.keyword` are included.
+func mappingFields(properties json.RawMessage) (map[string]string, error) {
+	fields := make(map[string]string)
+	aliases := make(map[string]string)
+
+	var walk func(prefix string, properties json.RawMessage) error
+	walk = func(prefix string, properties json.RawMessage) error {
+		if len(bytes.TrimSpace(properties)) == 0 {
+			return nil
+		}
+		var props map[string]fieldMapping
+		if err := json.Unmarshal(properties, &props); err != nil {
+			return err
+		}
+		for name, f := range props {
+			name = prefix + name
+			switch {
+			case f.Type == "alias":
+				aliases[name] = f.Path
+			case f.Type == "":
+				fields[name] = "object"
+			default:
+				fields[name] = f.Type
+			}
+			for sub, sf := range f.Fields {
+				fields[name+"."+sub] = sf.Type
+			}
+			if err := walk(name+".", f.Properties); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk("", properties); err != nil {
+		return nil, err
+	}
+
+	for name, path := range aliases {
+		if typ, ok := fields[path]; ok {
+			fields[name] = typ
+		}
+	}
+	return fields, nil
+}
+
+// FieldType returns the mapped type of field in the given index and
+// mapping type. An empty typ matches every mapping type of the index. The
+// second result is false if the field is not mapped.
+func (s *Schema) FieldType(index, typ, field string) (string, bool) {
+	types := s.mappings[index]
+	if fields, ok := types[typ]; ok {
+		t, ok := fields[field]
+		return t, ok
+	}
+	// Typeless mappings apply to every type, and a missing type to every
+	// mapping.
+	if fields, ok := types[""]; ok {
+		t, ok := fields[field]
+		return t, ok
+	}
+	if typ == "" {
+		for _, name := range s.Types(index) {
+			if t, ok := types[name][field]; ok {
+				return t, true
+			}
+		}
+	}
+	return "", false
+}
+
+// HasIndex returns true if a mapping was loaded for index.
+func (s *Schema) HasIndex(index string) bool {
+	_, ok := s.mappings[index]
+	return ok
+}
+
+// Types returns the mapping types of index in sorted order. A typeless
+// mapping is returned as "".
+func (s *Schema) Types(index string) []string {
+	var a []string
+	for typ := range s.mappings[index] {
+		a = append(a, typ)
+	}
+	sort.Strings(a)
+	return a
+}
+
+// Fields returns the field types of a mapping type of index by dotted
+// field name.
+func (s *Schema) Fields(index, typ string) map[string]string {
+	fields := make(map[string]string, len(s.mappings[index][typ]))
+	for name, t := range s.mappings[index][typ] {
+		fields[name] = t
+	}
+	return fields
+}
+
+// Validate checks that every condition of stmt names a mapped field and
+// that its operator and value fit the field type. Conditions on indices
+// without a loaded mapping are not checked. The error points at the
+// offending condition.
+func (s *Schema) Validate(stmt Statement) error {
+	var refs []*IndexRef
+	var where Expr
+	switch stmt := stmt.(type) {
+	case *SelectStatement:
+		refs, where = stmt.Indices, stmt.Where
+	case *CountStatement:
+		refs, where = stmt.Indices, stmt.Where
+	default:
+		return nil
+	}
+
+	for _, cond := range Conditions(where) {
+		if cond.Index == "" {
+			if err := s.validateUnqualified(cond, refs); err != nil {
+				return err
+			}
+			continue
+		}
+		if !s.HasIndex(cond.Index) {
+			continue
+		}
+		if err := s.validateCondition(cond, indexTypes(refs, cond.Index)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateUnqualified checks a condition that applies to every index. The
+// field must be mapped by at least one of the indices with a loaded
+// mapping, and its operator and value must fit wherever it is.
+func (s *Schema) validateUnqualified(cond *Condition, refs []*IndexRef) error {
+	checked, found := false, false
+	for _, ref := range refs {
+		if !s.HasIndex(ref.Name) {
+			continue
+		}
+		checked = true
+		ftype, ok := s.FieldType(ref.Name, ref.Type, cond.Field)
+		if !ok {
+			continue
+		}
+		found = true
+		if msg := operandFits(cond, ftype); msg != "" {
+			return &ParseError{Message: msg, Found: "*." + cond.Field, Pos: cond.Pos}
+		}
+	}
+	if checked && !found {
+		return &ParseError{Message: fmt.Sprintf("unknown field %s in any index", cond.Field), Found: "*." + cond.Field, Expected: []string{"field name"}, Pos: cond.Pos}
+	}
+	return nil
+}
+
+// validateCondition checks a condition against the mapping of each type
+// the statement names for its index.
+func (s *Schema) validateCondition(cond *Condition, types []string) error {
+	for _, typ := range types {
+		mapping := s.mappings[cond.Index]
+		if _, ok := mapping[typ]; !ok && typ != "" && mapping[""] == nil {
+			return &ParseError{Message: fmt.Sprintf("index %s has no mapping type %s", cond.Index, typ), Found: cond.Index + "." + cond.Field, Pos: cond.Pos}
+		}
+		ftype, ok := s.FieldType(cond.Index, typ, cond.Field)
+		if !ok {
+			name := cond.Index
+			if typ != "" {
+				name += "'" + typ
+			}
+			msg := fmt.Sprintf("unknown field %s in %s", cond.Field, name)
+			if near := s.nearestField(cond.Index, typ, cond.Field); near != "" {
+				msg += fmt.Sprintf(" (did you mean %s?)", near)
+			}
+			return &ParseError{Message: msg, Found: cond.Index + "." + cond.Field, Expected: []string{"field name"}, Pos: cond.Pos}
+		}
+		if msg := operandFits(cond, ftype); msg != "" {
+			return &ParseError{Message: msg, Found: cond.Index + "." + cond.Field, Pos: cond.Pos}
+		}
+	}
+	return nil
+}
+
+// nearestField returns the mapped field closest to a misspelt field, or
+// "" if none is within two edits.
+func (s *Schema) nearestField(index, typ, field string) string {
+	var names []string
+	for t, fields := range s.mappings[index] {
+		if typ == "" || t == typ || t == "" {
+			for name := range fields {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	best, bestDist := "", 3
+	for _, name := range names {
+		if d := editDistance(field, name); d < bestDist {
+			best, bestDist = name, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if d := prev[j] + 1; d < cur[j] {
+				cur[j] = d
+			}
+			if d := cur[j-1] + 1; d < cur[j] {
+				cur[j] = d
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// operandFits returns a message describing why the operator or value of
+// cond does not fit a field of type ftype, or "" if it does.
+func operandFits(cond *Condition, ftype string) string {
+	// Every field can be tested for a missing value.
+	if _, ok := cond.Value.(*NullLiteral); ok {
+		return ""
+	}
+
+	op := cond.Op
+	switch ftype {
+	case "long", "integer", "short", "byte", "double", "float", "half_float", "scaled_float", "unsigned_long":
+		if op == PF || op == SF {
+			return fmt.Sprintf("%s does not apply to %s field %s", op, ftype, cond.Field)
+		}
+		if !isNumeric(cond.Value) {
+			return fmt.Sprintf("%s on %s field %s expects a number, found %s", op, ftype, cond.Field, cond.Value)
+		}
+	case "date", "date_nanos":
+		if op == PF || op == SF {
+			return fmt.Sprintf("%s does not apply to %s field %s", op, ftype, cond.Field)
+		}
+		switch cond.Value.(type) {
+		case *StringLiteral, *IntegerLiteral:
+		default:
+			return fmt.Sprintf("%s on %s field %s expects a time or epoch milliseconds, found %s", op, ftype, cond.Field, cond.Value)
+		}
+	case "boolean":
+		if op != EQ && op != NEQ {
+			return fmt.Sprintf("%s does not apply to %s field %s", op, ftype, cond.Field)
+		}
+		if _, ok := cond.Value.(*BooleanLiteral); !ok {
+			return fmt.Sprintf("%s on %s field %s expects TRUE or FALSE, found %s", op, ftype, cond.Field, cond.Value)
+		}
+	case "text", "match_only_text":
+		switch op {
+		case GT, GTE, LT, LTE:
+			return fmt.Sprintf("%s does not apply to %s field %s", op, ftype, cond.Field)
+		}
+	case "ip":
+		if op == PF || op == SF {
+			return fmt.Sprintf("%s does not apply to %s field %s", op, ftype, cond.Field)
+		}
+		if _, ok := cond.Value.(*StringLiteral); !ok {
+			return fmt.Sprintf("%s on %s field %s expects a string, found %s", op, ftype, cond.Field, cond.Value)
+		}
+	case "object":
+		return fmt.Sprintf("%s is an object and cannot be compared", cond.Field)
+	case "nested":
+		return fmt.Sprintf("%s is a nested object and cannot be compared", cond.Field)
+	}
+	return ""
+}
+
+// indexTypes returns the types the statement names for index. A single ""
+// is returned when the index is not listed.
+func indexTypes(refs []*IndexRef, index string) []string {
+	var types []string
+	for _, ref := range refs {
+		if ref.Name == index {
+			types = append(types, ref.Type)
+		}
+	}
+	if len(types) == 0 {
+		return []string{""}
+	}
+	return types
+}
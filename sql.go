@@ -0,0 +1,522 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// timeRangeExpr is a `ts BETWEEN a AND b` on time values while parsing a
+// WHERE clause. It is lifted out of the expression into the AT window.
+type timeRangeExpr struct {
+	tr  *TimeRange
+	pos Pos
+}
+
+func (*timeRangeExpr) expr() {}
+
+// parseSQLSelectStatement parses a SQL statement such as
+// `SELECT host, msg FROM web'doc WHERE status >= 500 AND @timestamp BETWEEN 'now-1h' AND 'now' ORDER BY bytes DESC LIMIT 10`
+// into the same structure as LOOK. The BETWEEN on the compiler's TimeField
+// becomes the AT window and is required. Fields starting with a FROM
+// index and "." are qualified with it; other fields are left unqualified
+// and apply to every index.
+// This function assumes the SELECT token has already been consumed.
+func (p *Parser) parseSQLSelectStatement() (*SelectStatement, error) {
+	stmt := &SelectStatement{}
+	var err error
+	if stmt.Fields, stmt.Metrics, err = p.parseSQLFields(); err != nil {
+		return nil, err
+	}
+	if err := p.expect(FROM); err != nil {
+		return nil, err
+	}
+	if stmt.Indices, err = p.parseSQLIndices(); err != nil {
+		return nil, err
+	}
+	p.qualifyProjection(stmt)
+
+	tok, pos, lit := p.scanIgnoreWhitespace()
+	if tok != WHERE {
+		p.unscan()
+		return nil, &ParseError{Message: "SELECT requires a time BETWEEN in WHERE", Found: lit, Expected: []string{"WHERE"}, Pos: pos}
+	}
+	expr, err := p.parseSQLExpr(stmt.Indices)
+	if err != nil {
+		return nil, err
+	}
+	if stmt.Where, stmt.Time, err = liftTimeRange(expr); err != nil {
+		return nil, err
+	}
+	if stmt.Time == nil {
+		return nil, &ParseError{Message: "SELECT requires a time BETWEEN in WHERE", Pos: pos}
+	}
+
+	if tok, _, _ := p.scanIgnoreWhitespace(); tok == GROUP {
+		if err := p.expect(BY); err != nil {
+			return nil, err
+		}
+		for {
+			ref := &FieldRef{}
+			if ref.Index, ref.Field, ref.Pos, err = p.parseSQLFieldRef(stmt.Indices, false); err != nil {
+				return nil, err
+			}
+			stmt.GroupBy = append(stmt.GroupBy, ref)
+			if tok, _, _ := p.scanIgnoreWhitespace(); tok != COMMA {
+				p.unscan()
+				break
+			}
+		}
+	} else {
+		p.unscan()
+	}
+
+	if tok, _, _ := p.scanIgnoreWhitespace(); tok == ORDER {
+		if err := p.expect(BY); err != nil {
+			return nil, err
+		}
+		for {
+			f := &SortField{}
+			if f.Index, f.Field, f.Pos, err = p.parseSQLFieldRef(stmt.Indices, false); err != nil {
+				return nil, err
+			}
+			if err := p.parseSortOrder(f); err != nil {
+				return nil, err
+			}
+			stmt.SortFields = append(stmt.SortFields, f)
+			if tok, _, _ := p.scanIgnoreWhitespace(); tok != COMMA {
+				p.unscan()
+				break
+			}
+		}
+	} else {
+		p.unscan()
+	}
+
+	if tok, _, _ := p.scanIgnoreWhitespace(); tok == LIMIT {
+		if stmt.Limit, err = p.parseInt(1); err != nil {
+			return nil, err
+		}
+		if tok, _, _ := p.scanIgnoreWhitespace(); tok == OFFSET {
+			if stmt.Offset, err = p.parseInt(0); err != nil {
+				return nil, err
+			}
+		} else {
+			p.unscan()
+		}
+	} else {
+		p.unscan()
+	}
+	return stmt, nil
+}
+
+// parseSQLFields parses the comma separated SELECT list. A lone `*`
+// selects every field.
+func (p *Parser) parseSQLFields() ([]*Field, []*Metric, error) {
+	var fields []*Field
+	var metrics []*Metric
+	for {
+		f, m, err := p.parseProjectionItem(nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		if m != nil {
+			metrics = append(metrics, m)
+		} else {
+			fields = append(fields, f)
+		}
+
+		if tok, _, _ := p.scanIgnoreWhitespace(); tok != COMMA {
+			p.unscan()
+			break
+		}
+	}
+	if len(fields) == 1 && len(metrics) == 0 && fields[0].Pattern == "*" && !fields[0].Exclude && !fields[0].DocValue {
+		fields = nil
+	}
+	return fields, metrics, nil
+}
+
+// parseSQLIndices parses the FROM list of indices with an optional type,
+// such as `web, logs-2018'doc`.
+func (p *Parser) parseSQLIndices() ([]*IndexRef, error) {
+	var refs []*IndexRef
+	for {
+		tok, pos, lit := p.scanIgnoreWhitespace()
+		if !isNameToken(tok) {
+			p.unscan()
+			return nil, newParseError(lit, []string{"index name"}, pos)
+		}
+		p.unscan()
+
+		ref, err := p.parseIndexRef(COMMA, WHERE)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+
+		if tok, _, _ := p.scanIgnoreWhitespace(); tok != COMMA {
+			p.unscan()
+			return refs, nil
+		}
+	}
+}
+
+// qualifyProjection rewrites the SELECT list once the FROM indices are
+// known. Patterns lose their index qualifier and metric fields are
+// qualified as in WHERE where they are valid field names.
+func (p *Parser) qualifyProjection(stmt *SelectStatement) {
+	for _, f := range stmt.Fields {
+		if index, field := qualify(stmt.Indices, f.Pattern); index != "" {
+			f.Pattern = field
+		}
+	}
+	for _, m := range stmt.Metrics {
+		if m.Field == "*" {
+			continue
+		}
+		name := m.Field
+		if m.Index != "" {
+			name = m.Index + "." + m.Field
+		}
+		if index, field := qualify(stmt.Indices, name); index != "" {
+			m.Index, m.Field = index, field
+		} else if parsesAs(name, (*Parser).parseFieldPath) {
+			m.Index, m.Field = "", name
+		}
+	}
+}
+
+// parseSQLExpr parses an OR expression of a WHERE clause.
+func (p *Parser) parseSQLExpr(indices []*IndexRef) (Expr, error) {
+	expr, err := p.parseSQLAndExpr(indices)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if tok, _, _ := p.scanIgnoreWhitespace(); tok != OR {
+			p.unscan()
+			return expr, nil
+		}
+		rhs, err := p.parseSQLAndExpr(indices)
+		if err != nil {
+			return nil, err
+		}
+		expr = &BinaryExpr{Op: OR, LHS: expr, RHS: rhs}
+	}
+}
+
+// parseSQLAndExpr parses an AND expression, which binds tighter than OR.
+func (p *Parser) parseSQLAndExpr(indices []*IndexRef) (Expr, error) {
+	expr, err := p.parseSQLUnaryExpr(indices)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if tok, _, _ := p.scanIgnoreWhitespace(); tok != AND {
+			p.unscan()
+			return expr, nil
+		}
+		rhs, err := p.parseSQLUnaryExpr(indices)
+		if err != nil {
+			return nil, err
+		}
+		expr = &BinaryExpr{Op: AND, LHS: expr, RHS: rhs}
+	}
+}
+
+// parseSQLUnaryExpr parses a NOT expression, a parenthesized expression
+// or a single comparison.
+func (p *Parser) parseSQLUnaryExpr(indices []*IndexRef) (Expr, error) {
+	tok, pos, lit := p.scanIgnoreWhitespace()
+	switch tok {
+	case NOT:
+		expr, err := p.parseSQLUnaryExpr(indices)
+		if err != nil {
+			return nil, err
+		}
+		return &NotExpr{Expr: expr}, nil
+	case ParLeft:
+		expr, err := p.parseSQLExpr(indices)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(ParRight); err != nil {
+			return nil, err
+		}
+		return &ParenExpr{Expr: expr}, nil
+	case IDENT, INTEGER, NUMBER:
+		p.unscan()
+		return p.parseSQLComparison(indices)
+	case ILLEGAL:
+		if lit == "@" {
+			p.unscan()
+			return p.parseSQLComparison(indices)
+		}
+	}
+	p.unscan()
+	return nil, newParseError(lit, []string{"field name", "NOT", "("}, pos)
+}
+
+// parseSQLComparison parses a comparison such as `status >= 500`,
+// `host LIKE 'web%'`, `user IS NOT NULL` or `ts BETWEEN a AND b`.
+func (p *Parser) parseSQLComparison(indices []*IndexRef) (Expr, error) {
+	index, field, pos, err := p.parseSQLFieldRef(indices, true)
+	if err != nil {
+		return nil, err
+	}
+	cond := &Condition{Index: index, Field: field, Pos: pos}
+
+	// A time field that is not a valid field path, such as @timestamp,
+	// can only make the AT window.
+	tok, opPos, lit := p.scanIgnoreWhitespace()
+	if tok != BETWEEN && !parsesAs(field, (*Parser).parseFieldPath) {
+		p.unscan()
+		return nil, &ParseError{Message: fmt.Sprintf("the time field %s can only be used with BETWEEN", field), Found: lit, Expected: []string{"BETWEEN"}, Pos: opPos}
+	}
+	pos = opPos
+	switch tok {
+	case EQSIGN:
+		cond.Op = EQ
+	case NEQSIGN:
+		cond.Op = NEQ
+	case PointRight:
+		cond.Op = GT
+	case GTESIGN:
+		cond.Op = GTE
+	case LTSIGN:
+		cond.Op = LT
+	case LTESIGN:
+		cond.Op = LTE
+	case LIKE:
+		_, valPos, _ := p.scanIgnoreWhitespace()
+		p.unscan()
+		s, err := p.parseString()
+		if err != nil {
+			return nil, err
+		}
+		if cond.Op, s, err = likePattern(s); err != nil {
+			return nil, &ParseError{Message: err.Error(), Found: s, Expected: []string{"pattern"}, Pos: valPos}
+		}
+		cond.Value = &StringLiteral{Val: s}
+		return cond, nil
+	case BETWEEN:
+		return p.parseSQLBetween(cond)
+	case IDENT:
+		if strings.ToUpper(lit) != "IS" {
+			break
+		}
+		cond.Op, cond.Value = EQ, &NullLiteral{}
+		if tok, _, _ := p.scanIgnoreWhitespace(); tok == NOT {
+			cond.Op = NEQ
+		} else {
+			p.unscan()
+		}
+		if err := p.expect(NULL); err != nil {
+			return nil, err
+		}
+		return cond, nil
+	}
+	if cond.Op == ILLEGAL {
+		p.unscan()
+		return nil, newParseError(lit, []string{"=", "!=", "<>", ">", ">=", "<", "<=", "LIKE", "BETWEEN", "IS"}, pos)
+	}
+
+	_, valPos, _ := p.scanIgnoreWhitespace()
+	p.unscan()
+	if cond.Value, err = p.parseLiteral(); err != nil {
+		return nil, err
+	}
+	if err := checkOperand(cond.Op, cond.Value, valPos); err != nil {
+		return nil, err
+	}
+	return cond, nil
+}
+
+// parseSQLBetween parses the bounds of a BETWEEN. On the time field, two
+// time strings make the time window; any other BETWEEN becomes a GTE and
+// an LTE condition.
+// This function assumes the BETWEEN token has already been consumed.
+func (p *Parser) parseSQLBetween(cond *Condition) (Expr, error) {
+	_, pos, _ := p.scanIgnoreWhitespace()
+	p.unscan()
+	lower, err := p.parseLiteral()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(AND); err != nil {
+		return nil, err
+	}
+	_, upperPos, _ := p.scanIgnoreWhitespace()
+	p.unscan()
+	upper, err := p.parseLiteral()
+	if err != nil {
+		return nil, err
+	}
+
+	if cond.Field == p.timeField {
+		if tr := p.timeBetween(lower, upper); tr != nil {
+			if tr.Begin.IsMath() || tr.End.IsMath() || !tr.Begin.Time.After(tr.End.Time) {
+				return &timeRangeExpr{tr: tr, pos: pos}, nil
+			}
+			return nil, &ParseError{Message: "time range begins after it ends", Pos: pos}
+		}
+		if !parsesAs(cond.Field, (*Parser).parseFieldPath) {
+			return nil, &ParseError{Message: fmt.Sprintf("BETWEEN on %s expects two time values", cond.Field), Pos: pos}
+		}
+	}
+
+	if err := checkOperand(GTE, lower, pos); err != nil {
+		return nil, err
+	}
+	if err := checkOperand(LTE, upper, upperPos); err != nil {
+		return nil, err
+	}
+	return &ParenExpr{Expr: &BinaryExpr{
+		Op:  AND,
+		LHS: &Condition{Index: cond.Index, Field: cond.Field, Op: GTE, Value: lower, Pos: cond.Pos},
+		RHS: &Condition{Index: cond.Index, Field: cond.Field, Op: LTE, Value: upper, Pos: cond.Pos},
+	}}, nil
+}
+
+// timeBetween returns the window between two string literals, or nil if
+// either is not a time value.
+func (p *Parser) timeBetween(lower, upper Literal) *TimeRange {
+	l, ok := lower.(*StringLiteral)
+	u, ok2 := upper.(*StringLiteral)
+	if !ok || !ok2 {
+		return nil
+	}
+	begin, err := p.timeBound(l.Val, Pos{})
+	if err != nil {
+		return nil
+	}
+	end, err := p.timeBound(u.Val, Pos{})
+	if err != nil {
+		return nil
+	}
+	return &TimeRange{Begin: begin, End: end}
+}
+
+// parseSQLFieldRef parses a field such as `status`, `http.status` or
+// `web.http.status`. Fields that do not start with a FROM index followed
+// by "." are returned with an empty index. If timeOK is set the field
+// may also be the time field, such as `@timestamp`.
+func (p *Parser) parseSQLFieldRef(indices []*IndexRef, timeOK bool) (index, field string, pos Pos, err error) {
+	tok, pos, lit := p.scanIgnoreWhitespace()
+	name := ""
+	if tok == ILLEGAL && lit == "@" {
+		name = lit
+		tok, _, lit = p.scan()
+	}
+	if !isNameToken(tok) {
+		p.unscan()
+		return "", "", pos, newParseError(name+lit, []string{"field name"}, pos)
+	}
+	name += lit
+	for {
+		tok, _, lit := p.scan()
+		// After a "." the @ of a time field and keywords are part of the name.
+		at := tok == ILLEGAL && lit == "@" && strings.HasSuffix(name, ".")
+		keyword := isKeyword(tok) && strings.HasSuffix(name, ".")
+		if !isNameToken(tok) && tok != Point && tok != MIDEND && !at && !keyword {
+			p.unscan()
+			break
+		}
+		name += lit
+	}
+
+	index, field = qualify(indices, name)
+	if !parsesAs(field, (*Parser).parseFieldPath) && !(timeOK && field == p.timeField) {
+		return "", "", pos, &ParseError{Message: fmt.Sprintf("invalid field name %q", field), Found: name, Expected: []string{"field name"}, Pos: pos}
+	}
+	return index, field, pos, nil
+}
+
+// qualify splits name into a FROM index and the rest when it starts with
+// the index followed by ".". The longest matching index wins.
+func qualify(indices []*IndexRef, name string) (index, field string) {
+	for _, ref := range indices {
+		if strings.HasPrefix(name, ref.Name+".") && len(ref.Name) > len(index) {
+			index = ref.Name
+		}
+	}
+	if index == "" {
+		return "", name
+	}
+	return index, name[len(index)+1:]
+}
+
+// likePattern returns the condition for a LIKE pattern: PF for `abc%`, SF
+// for `%abc` and EQ for a pattern without wildcards.
+func likePattern(s string) (Token, string, error) {
+	if strings.Contains(s, "_") {
+		return ILLEGAL, s, fmt.Errorf("LIKE pattern %q: _ wildcards are not supported", s)
+	}
+	switch n := strings.Count(s, "%"); {
+	case n == 0:
+		return EQ, s, nil
+	case n == 1 && strings.HasSuffix(s, "%"):
+		return PF, strings.TrimSuffix(s, "%"), nil
+	case n == 1 && strings.HasPrefix(s, "%"):
+		return SF, strings.TrimPrefix(s, "%"), nil
+	}
+	return ILLEGAL, s, fmt.Errorf("LIKE pattern %q must be a prefix or suffix pattern", s)
+}
+
+// liftTimeRange removes the time BETWEEN from the top-level AND chain of
+// expr and returns it as the window. A time BETWEEN anywhere else cannot
+// be expressed as an AT window.
+func liftTimeRange(expr Expr) (Expr, *TimeRange, error) {
+	switch e := expr.(type) {
+	case *timeRangeExpr:
+		return nil, e.tr, nil
+	case *BinaryExpr:
+		if e.Op != AND {
+			break
+		}
+		lhs, ltr, err := liftTimeRange(e.LHS)
+		if err != nil {
+			return nil, nil, err
+		}
+		rhs, rtr, err := liftTimeRange(e.RHS)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ltr != nil && rtr != nil {
+			return nil, nil, &ParseError{Message: "only one time BETWEEN is allowed", Pos: findTimeRange(e.RHS).pos}
+		}
+		if ltr == nil {
+			ltr = rtr
+		}
+		switch {
+		case lhs == nil:
+			return rhs, ltr, nil
+		case rhs == nil:
+			return lhs, ltr, nil
+		}
+		return &BinaryExpr{Op: AND, LHS: lhs, RHS: rhs}, ltr, nil
+	}
+
+	if e := findTimeRange(expr); e != nil {
+		return nil, nil, &ParseError{Message: "a time BETWEEN must be ANDed with the rest of WHERE", Pos: e.pos}
+	}
+	return expr, nil, nil
+}
+
+// findTimeRange returns the first time BETWEEN within expr.
+func findTimeRange(expr Expr) *timeRangeExpr {
+	switch e := expr.(type) {
+	case *timeRangeExpr:
+		return e
+	case *BinaryExpr:
+		if t := findTimeRange(e.LHS); t != nil {
+			return t
+		}
+		return findTimeRange(e.RHS)
+	case *NotExpr:
+		return findTimeRange(e.Expr)
+	case *ParenExpr:
+		return findTimeRange(e.Expr)
+	}
+	return nil
+}
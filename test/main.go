@@ -6,30 +6,50 @@ import (
 	"regexp"
 	"strings"
 
-	"../parser" //TODO
+	parser "github.com/Maary/elastic_search_parser"
 )
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	sen1 := `LOOK (indexname1'typename, indexname2'typename2, indexname3'typename3):
-                 CONDITION  [ indexName1.field1 GT 100, indexName1.field1 NEQ "a32bd", indexName2.field3 NEQ 123.123 ,indexName2.field2 LT 100, index2.field2 EQ 123, index3.field4 SF "ab2c32", index3.field2 GTE 1000, index4.file4 LTE 120]
-                 AT [ 2018.14.23:12.23.45 - 2018.12.13:12.12.12]`
-	//sen2 := `RECENT (indexname1'typename, indexname2'typename2) :
-	//TOTAL [100]
-	//AT [2018.14.23:12.23.45 - 2018.12.13.12.12.12]`
+                 CONDITION  [ indexName1.field1 GT 100, indexName1.field1 NEQ "a32bd", indexName2.field3 NEQ 123.123 ,indexName2.field2 LT 100, 2.field2 EQ 123, 3.field4 SF "ab2c32", indexname3.field2 GTE 1000, 1.file4 LTE 120]
+                 AT [ 2018.11.23:12.23.45 - 2018.12.13:12.12.12]`
+	sen2 := `RECENT (indexname1'typename, indexname2'typename2) :
+                 TOTAL [100]
+                 AT [2018.11.23:12.23.45 - 2018.12.13:12.12.12]`
 
 	r1 := strings.NewReader(sen1)
 
 	p1 := parser.NewParser(r1)
-	resu1, err := p1.Parse()
-	fmt.Printf("%+v\n", resu1.IndexToTypeSet)
-	for _, v := range resu1.IndexToFieldSet {
-		for k, va := range v {
-			fmt.Println(k, va)
-		}
+	stmt, err := p1.Parse()
+	if err != nil {
+		log.Fatalln("[ERROR] => ", err)
 	}
-	fmt.Println(resu1.TimeBegin, resu1.TimeEnd)
-	log.Println("[ERROR] => ", err)
+	resu1 := stmt.(*parser.SelectStatement)
+	for _, ref := range resu1.Indices {
+		fmt.Printf("%+v\n", ref)
+	}
+	for _, cond := range parser.Conditions(resu1.Where) {
+		fmt.Println(cond.Index, cond.Field, cond.Op, cond.Value)
+	}
+	fmt.Println(resu1.Time.Begin, resu1.Time.End)
+
+	// Conditions must refer to an index of the LOOK list.
+	sen3 := `LOOK (indexname1'typename): CONDITION [index4.file4 LTE 120] AT [now-1d - now]`
+	if _, err := parser.NewParser(strings.NewReader(sen3)).Parse(); err != nil {
+		fmt.Println("[ERROR] => ", err)
+	}
+
+	stmt, err = parser.NewParser(strings.NewReader(sen2)).Parse()
+	if err != nil {
+		log.Fatalln("[ERROR] => ", err)
+	}
+	req, err := parser.NewCompiler().Compile(stmt)
+	if err != nil {
+		log.Fatalln("[ERROR] => ", err)
+	}
+	body, _ := req.JSON()
+	fmt.Println(req.Path(), string(body))
 
 }
 